@@ -0,0 +1,220 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/keminar/anyproxy/grace"
+	"github.com/keminar/anyproxy/nat"
+	"github.com/keminar/anyproxy/proto"
+	"github.com/keminar/anyproxy/utils/cache"
+	"github.com/keminar/anyproxy/utils/conf"
+
+	"gopkg.in/yaml.v2"
+)
+
+// server 代理服务，查询和关闭连接
+var server *grace.Server
+
+// NewServer 启动管理接口，除PAC外都要认证
+func NewServer(addr string, srv *grace.Server) {
+	server = srv
+	mux := http.NewServeMux()
+	mux.HandleFunc("/route/explain", auth(routeExplain))
+	mux.HandleFunc("/config", auth(configShow))
+	mux.HandleFunc("/config/reload", auth(configReload))
+	mux.HandleFunc("/connections", auth(connections))
+	mux.HandleFunc("/connections/kill", auth(connectionKill))
+	mux.HandleFunc("/dns/stats", auth(dnsStats))
+	mux.HandleFunc("/dns/flush", auth(dnsFlush))
+	mux.HandleFunc("/upstreams", auth(upstreams))
+	mux.HandleFunc("/breakers", auth(breakers))
+	mux.HandleFunc("/nat/clients", auth(natClients))
+	// 系统获取PAC时不带认证
+	mux.HandleFunc("/proxy.pac", pac)
+	mux.HandleFunc("/wpad.dat", pac)
+
+	log.Printf("Listening for admin on %s\n", addr)
+	for i := 0; i < 1000; i++ {
+		// 副服务，出错不退出并定时重试。方便主服务做平滑重启
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Printf("Admin ListenAndServe: num=%d, err=%v ,retry\n", i, err)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// auth 配置了admin.token时校验 Authorization: Bearer token，未配置时只允许本机访问
+func auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := conf.Current().Admin.Token
+		if token == "" {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin.token is required for remote access"})
+				return
+			}
+		} else if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="anyproxy"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requirePost 修改类接口只接受POST
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method must be POST"})
+		return false
+	}
+	return true
+}
+
+// routeExplain 路由说明，参数 host=域名[:端口]&proto=http|https|tcp&from=客户端ip&user=登录用户
+func routeExplain(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("host") == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "host is required"})
+		return
+	}
+	e, err := proto.ExplainRoute(q.Get("host"), q.Get("proto"), q.Get("from"), q.Get("user"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+// configReload 重新加载配置文件，只接受POST，出错时保留旧配置并返回所有错误
+func configReload(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	if err := conf.Reload("admin"); err != nil {
+		errs, ok := err.(conf.ConfigErrors)
+		if !ok {
+			errs = conf.ConfigErrors{{Msg: err.Error()}}
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"error": "config reload failed", "errors": errs})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"result": "reloaded", "file": conf.ConfigFile})
+}
+
+// configShow 当前生效的配置，密码和密钥隐藏，字段名同配置文件
+func configShow(w http.ResponseWriter, r *http.Request) {
+	cnf := conf.Current().Redacted()
+	data, err := yaml.Marshal(&cnf)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	var v interface{}
+	if err = yaml.Unmarshal(data, &v); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"file": conf.ConfigFile, "config": jsonValue(v)})
+}
+
+// jsonValue yaml解析出的map键为interface{}，转为json可输出的string键
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, val := range x {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range x {
+			x[i] = jsonValue(val)
+		}
+	}
+	return v
+}
+
+// connections 活动连接
+func connections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, proto.Connections(server))
+}
+
+// connectionKill 按trace ID关闭连接，参数 id=数字，只接受POST
+func connectionKill(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id must be a trace ID"})
+		return
+	}
+	// 正在转发的连接同时关闭后端，其它只关闭客户端
+	if !proto.CloseConn(uint(id)) && !server.CloseConn(uint(id)) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("connection %d not found", id)})
+		return
+	}
+	log.Println("admin kill connection", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"result": "closed", "id": id})
+}
+
+// dnsStats DNS缓存命中统计
+func dnsStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cache.ResolveLookup.Stats())
+}
+
+// dnsFlush 清空DNS缓存，只接受POST
+func dnsFlush(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	cache.ResolveLookup.Flush()
+	writeJSON(w, http.StatusOK, map[string]string{"result": "flushed"})
+}
+
+// upstreams 代理组健康状态
+func upstreams(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, proto.Upstreams())
+}
+
+// breakers auto直连失败过的ip地址熔断状态，代理的熔断状态在upstreams中
+func breakers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, proto.AddrBreakers())
+}
+
+// natClients websocket服务端已连接的订阅者
+func natClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, nat.Clients())
+}
+
+// pac 按路由规则生成的PAC文件，带ETag，未修改时返回304
+func pac(w http.ResponseWriter, r *http.Request) {
+	cnf := conf.Current()
+	f := proto.PAC(cnf, proto.PACProxyAddr(cnf, r.Host))
+	w.Header().Set("ETag", f.ETag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == f.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", proto.PACContentType)
+	w.Write(f.Body)
+}
+
+// writeJSON 输出json
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -8,8 +8,10 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"reflect"
 	"time"
 
+	"github.com/keminar/anyproxy/admin"
 	"github.com/keminar/anyproxy/config"
 	"github.com/keminar/anyproxy/grace"
 	"github.com/keminar/anyproxy/logging"
@@ -32,6 +34,7 @@ var (
 	gDebug           int
 	gPprof           string
 	gVersion         bool
+	gTest            bool
 )
 
 func init() {
@@ -45,6 +48,7 @@ func init() {
 	flag.IntVar(&gDebug, "debug", 0, "debug mode (0, 1, 2, 3)")
 	flag.StringVar(&gPprof, "pprof", "", "pprof port, disable if empty")
 	flag.BoolVar(&gVersion, "v", false, "Show build version")
+	flag.BoolVar(&gTest, "t", false, "Test config file and exit")
 	flag.BoolVar(&gHelp, "h", false, "This usage message")
 }
 
@@ -58,19 +62,28 @@ func main() {
 		help.ShowVersion()
 		return
 	}
+	// 检查配置文件
+	if gTest {
+		os.Exit(testConfig())
+	}
+	// 子命令，如 route explain
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 
 	config.SetDebugLevel(gDebug)
 	conf.LoadAllConfig(gConfigFile)
 
 	// 检查配置是否存在
-	if conf.RouterConfig == nil {
+	cnf := conf.Current()
+	if cnf == nil {
 		time.Sleep(60 * time.Second)
 		os.Exit(2)
 	}
 
 	cmdName := "anyproxy"
 	defLogDir := fmt.Sprintf("%s%s%s%s", conf.AppPath, string(os.PathSeparator), "logs", string(os.PathSeparator))
-	logDir := config.IfEmptyThen(conf.RouterConfig.Log.Dir, defLogDir, "")
+	logDir := config.IfEmptyThen(cnf.Log.Dir, defLogDir, "")
 	if _, err := os.Stat(logDir); err != nil {
 		log.Println(err)
 		time.Sleep(60 * time.Second)
@@ -82,7 +95,8 @@ func main() {
 	// 是否后台运行
 	daemon.Daemonize(envRunMode, fd)
 
-	gListenAddrPort = config.IfEmptyThen(gListenAddrPort, conf.RouterConfig.Listen, ":3000")
+	listenFlag, proxyFlag, wsConnFlag := gListenAddrPort, gProxyServerSpec, gWebsocketConn
+	gListenAddrPort = config.IfEmptyThen(gListenAddrPort, cnf.Listen, ":3000")
 	gListenAddrPort = tools.FillPort(gListenAddrPort)
 	config.SetListenPort(gListenAddrPort)
 
@@ -93,9 +107,9 @@ func main() {
 		writer = io.Writer(os.Stdout)
 	}
 
-	logging.SetDefaultLogger(logDir, fmt.Sprintf("%s.%d", cmdName, config.ListenPort), true, 3, writer)
+	logging.SetDefaultLogger(logDir, fmt.Sprintf("%s.%d", cmdName, config.ListenPort()), true, 3, writer)
 	// 设置代理
-	gProxyServerSpec = config.IfEmptyThen(gProxyServerSpec, conf.RouterConfig.Default.Proxy, "")
+	gProxyServerSpec = config.IfEmptyThen(gProxyServerSpec, cnf.Default.Proxy, "")
 	config.SetProxyServer(gProxyServerSpec)
 
 	// 调试模式
@@ -114,13 +128,13 @@ func main() {
 	}
 
 	// websocket 服务端
-	gWebsocketListen = config.IfEmptyThen(gWebsocketListen, conf.RouterConfig.Websocket.Listen, "")
+	gWebsocketListen = config.IfEmptyThen(gWebsocketListen, cnf.Websocket.Listen, "")
 	if gWebsocketListen != "" {
 		gWebsocketListen = tools.FillPort(gWebsocketListen)
 		go nat.NewServer(&gWebsocketListen)
 	}
 	// websocket 客户端
-	gWebsocketConn = config.IfEmptyThen(gWebsocketConn, conf.RouterConfig.Websocket.Connect, "")
+	gWebsocketConn = config.IfEmptyThen(gWebsocketConn, cnf.Websocket.Connect, "")
 	if gWebsocketConn != "" {
 		gWebsocketConn = tools.FillPort(gWebsocketConn)
 		go nat.ConnectServer(&gWebsocketConn)
@@ -130,15 +144,78 @@ func main() {
 	// tcp4  仅监听使用IPv4
 	// tcp6  仅监听使用IPv6
 	network := "tcp"
-	if conf.RouterConfig.Network != "" {
-		network = conf.RouterConfig.Network
+	if cnf.Network != "" {
+		network = cnf.Network
 	}
 	// 运行模式
+	handler := proto.ClientHandler
 	if gMode == "tunnel" {
-		server := grace.NewServer(gListenAddrPort, proto.ServerHandler, network)
-		server.ListenAndServe()
-	} else {
-		server := grace.NewServer(gListenAddrPort, proto.ClientHandler, network)
-		server.ListenAndServe()
+		enabled, err := proto.CheckTunnelTLS()
+		if err != nil {
+			log.Println("tunnel tls config err", err)
+			time.Sleep(60 * time.Second)
+			os.Exit(2)
+		}
+		if enabled {
+			log.Println("Tunnel tls is enabled")
+		}
+		handler = proto.ServerHandler
+	}
+	server := grace.NewServer(gListenAddrPort, handler, network)
+
+	// 管理接口
+	if cnf.Admin.Listen != "" {
+		go admin.NewServer(tools.FillPort(cnf.Admin.Listen), server)
 	}
+
+	// 配置重新加载后生效，命令行参数指定的不跟随配置
+	if listenFlag == "" {
+		conf.OnReload("listen", func(old, cnf *conf.Router) {
+			if old.Listen == cnf.Listen && old.Network == cnf.Network {
+				return
+			}
+			addr := tools.FillPort(config.IfEmptyThen(cnf.Listen, ":3000", ""))
+			if err := server.Rebind(addr, config.IfEmptyThen(cnf.Network, "tcp", "")); err != nil {
+				log.Println("config reload listen err", err)
+				return
+			}
+			config.SetListenPort(addr)
+		})
+	}
+	if proxyFlag == "" {
+		conf.OnReload("proxy", func(old, cnf *conf.Router) {
+			if old.Default.Proxy != cnf.Default.Proxy {
+				config.SetProxyServer(cnf.Default.Proxy)
+			}
+		})
+	}
+	if wsConnFlag == "" {
+		conf.OnReload("websocket", func(old, cnf *conf.Router) {
+			if !reflect.DeepEqual(old.Websocket, cnf.Websocket) {
+				nat.ReloadClient(tools.FillPort(cnf.Websocket.Connect))
+			}
+		})
+	}
+	conf.OnReload("logging", func(old, cnf *conf.Router) {
+		if old.Log.Dir == cnf.Log.Dir {
+			return
+		}
+		logDir := config.IfEmptyThen(cnf.Log.Dir, defLogDir, "")
+		if _, err := os.Stat(logDir); err != nil {
+			log.Println("config reload log dir err", err)
+			return
+		}
+		logging.SetDefaultLogger(logDir, fmt.Sprintf("%s.%d", cmdName, config.ListenPort()), true, 3, writer)
+	})
+	conf.OnReload("restart", func(old, cnf *conf.Router) {
+		if old.Websocket.Listen != cnf.Websocket.Listen || old.Admin.Listen != cnf.Admin.Listen {
+			log.Println("config reload: websocket.listen and admin.listen take effect after restart")
+		}
+	})
+	conf.ReloadOnSignal()
+	proto.StartDNSCache()
+	proto.StartUpstreams()
+
+	server.ListenAndServe()
+	proto.SaveDNSCache()
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/proto"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// runCommand 执行子命令，返回退出码
+func runCommand(args []string) int {
+	if len(args) >= 2 && args[0] == "route" && args[1] == "explain" {
+		return routeExplain(args[2:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", strings.Join(args, " "))
+	return 2
+}
+
+// testConfig 检查配置文件，和 nginx -t 一样输出所有错误
+func testConfig() int {
+	filePath, err := conf.CheckConfig(gConfigFile)
+	if filePath == "" {
+		filePath = config.IfEmptyThen(gConfigFile, "router.yaml", "")
+	}
+	if err != nil {
+		if errs, ok := err.(conf.ConfigErrors); ok {
+			for _, e := range errs {
+				if e.Line > 0 {
+					fmt.Fprintf(os.Stderr, "anyproxy: %s:%d: %s\n", filePath, e.Line, e.Msg)
+				} else {
+					fmt.Fprintf(os.Stderr, "anyproxy: %s: %s\n", filePath, e.Msg)
+				}
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "anyproxy: %s: %s\n", filePath, err)
+		}
+		fmt.Fprintf(os.Stderr, "anyproxy: configuration file %s test failed\n", filePath)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "anyproxy: the configuration file %s syntax is ok\n", filePath)
+	fmt.Fprintf(os.Stderr, "anyproxy: configuration file %s test is successful\n", filePath)
+	return 0
+}
+
+// routeExplain 说明目标地址会匹配哪条规则、怎么走，不转发数据
+func routeExplain(args []string) int {
+	fs := flag.NewFlagSet("route explain", flag.ContinueOnError)
+	protoName := fs.String("proto", "http", "request proto (http, https, tcp)")
+	from := fs.String("from", "", "client ip")
+	user := fs.String("user", "", "login user")
+	asJSON := fs.Bool("json", false, "output json")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-c router.yaml] route explain <host[:port]> [-proto http|https|tcp] [-from ip] [-user name] [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	// 目标地址写在参数前面时先取出来
+	var target string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		target, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if target == "" {
+		target = fs.Arg(0)
+	}
+	if target == "" {
+		fs.Usage()
+		return 2
+	}
+
+	conf.LoadAllConfig(gConfigFile)
+	cnf := conf.Current()
+	if cnf == nil {
+		return 2
+	}
+	config.SetProxyServer(config.IfEmptyThen(gProxyServerSpec, cnf.Default.Proxy, ""))
+	// 代理可用状态由健康检查得出，命令行先检查一次
+	proto.CheckUpstreams()
+
+	e, err := proto.ExplainRoute(target, *protoName, *from, *user)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(e, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(e.String())
+	}
+	return 0
+}
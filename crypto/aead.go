@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// TunnelVersion CONNECT目标地址加密协议版本
+const TunnelVersion byte = 0x01
+
+var (
+	// ErrVersion 协议版本不支持
+	ErrVersion = errors.New("crypto: tunnel version is not supported")
+	// ErrReplay 重放请求
+	ErrReplay = errors.New("crypto: replayed request")
+	// ErrExpired 时间戳超出窗口
+	ErrExpired = errors.New("crypto: timestamp out of window")
+)
+
+// DeriveKey 由token派生AES-256密钥，token不再要求16位长度
+func DeriveKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("anyproxy tunnel key v1"))
+	return mac.Sum(nil)
+}
+
+// SealTarget AES-GCM加密
+// 格式: version(1) nonce(12) ciphertext(timestamp(8) target)，version做附加数据参与校验
+func SealTarget(target []byte, key []byte, now time.Time) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 1+aead.NonceSize(), 1+aead.NonceSize()+8+len(target)+aead.Overhead())
+	out[0] = TunnelVersion
+	nonce := out[1:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	plain := make([]byte, 8, 8+len(target))
+	binary.BigEndian.PutUint64(plain, uint64(now.Unix()))
+	plain = append(plain, target...)
+	return aead.Seal(out, nonce, plain, out[:1]), nil
+}
+
+// OpenTarget AES-GCM解密，返回目标地址、时间戳和nonce
+func OpenTarget(data []byte, key []byte) (target []byte, ts time.Time, nonce []byte, err error) {
+	if len(data) == 0 || data[0] != TunnelVersion {
+		err = ErrVersion
+		return
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return
+	}
+	if len(data) < 1+aead.NonceSize()+8+aead.Overhead() {
+		err = errors.New("crypto: ciphertext too short")
+		return
+	}
+	nonce = data[1 : 1+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[1+aead.NonceSize():], data[:1])
+	if err != nil {
+		return
+	}
+	ts = time.Unix(int64(binary.BigEndian.Uint64(plain[:8])), 0)
+	target = plain[8:]
+	return
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReplayFilter 防重放，时间窗口内同一个nonce只接受一次
+type ReplayFilter struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce => 过期时间
+	lastClean time.Time
+}
+
+// NewReplayFilter 实例
+func NewReplayFilter() *ReplayFilter {
+	return &ReplayFilter{
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Check 检查时间戳在窗口内且nonce未出现过
+func (f *ReplayFilter) Check(nonce []byte, ts time.Time, window time.Duration) error {
+	now := time.Now()
+	if ts.Before(now.Add(-window)) || ts.After(now.Add(window)) {
+		return ErrExpired
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// 定时清理过期的nonce
+	if now.Sub(f.lastClean) > window {
+		for k, v := range f.seen {
+			if v.Before(now) {
+				delete(f.seen, k)
+			}
+		}
+		f.lastClean = now
+	}
+	key := string(nonce)
+	if exp, ok := f.seen[key]; ok && exp.After(now) {
+		return ErrReplay
+	}
+	// 时间戳最晚在ts+window之后失效，nonce要保留到那时
+	f.seen[key] = ts.Add(window)
+	return nil
+}
@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSealOpenTarget(t *testing.T) {
+	key := DeriveKey("token")
+	now := time.Unix(1700000000, 0)
+	data, err := SealTarget([]byte("www.example.com:443"), key, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, ts, nonce, err := OpenTarget(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(target) != "www.example.com:443" || !ts.Equal(now) || !bytes.Equal(nonce, data[1:13]) {
+		t.Fatalf("got target %q ts %v nonce %x", target, ts, nonce)
+	}
+
+	// 换token解不开
+	if _, _, _, err := OpenTarget(data, DeriveKey("other")); err == nil {
+		t.Fatal("open with wrong key succeeded")
+	}
+}
+
+func TestOpenTargetTampered(t *testing.T) {
+	key := DeriveKey("token")
+	data, err := SealTarget([]byte("www.example.com:443"), key, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 版本号、nonce、密文任一字节被改都要失败
+	for i := 0; i < len(data); i++ {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x01
+		if _, _, _, err := OpenTarget(bad, key); err == nil {
+			t.Fatalf("tampered byte %d accepted", i)
+		}
+	}
+	if _, _, _, err := OpenTarget(data[:20], key); err == nil {
+		t.Fatal("short data accepted")
+	}
+	if _, _, _, err := OpenTarget(nil, key); !errors.Is(err, ErrVersion) {
+		t.Fatalf("empty data err = %v", err)
+	}
+}
+
+func TestReplayFilterWindow(t *testing.T) {
+	f := NewReplayFilter()
+	window := time.Minute
+	now := time.Now()
+	for _, ts := range []time.Time{now.Add(-window - time.Second), now.Add(window + time.Second)} {
+		if err := f.Check([]byte("nonce-expired"), ts, window); !errors.Is(err, ErrExpired) {
+			t.Fatalf("ts %v err = %v, want ErrExpired", ts, err)
+		}
+	}
+	if err := f.Check([]byte("nonce-ok"), now.Add(-window/2), window); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayFilterDuplicate(t *testing.T) {
+	f := NewReplayFilter()
+	window := 2 * time.Second
+	nonce := []byte("0123456789ab")
+	// 时间戳在窗口边缘，nonce记录100ms后过期
+	ts := time.Now().Add(-window + 100*time.Millisecond)
+	if err := f.Check(nonce, ts, window); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Check(nonce, ts, window); !errors.Is(err, ErrReplay) {
+		t.Fatalf("duplicate err = %v, want ErrReplay", err)
+	}
+	if err := f.Check(nonce, time.Now(), window); !errors.Is(err, ErrReplay) {
+		t.Fatalf("duplicate with new ts err = %v, want ErrReplay", err)
+	}
+	if err := f.Check([]byte("another nonce"), time.Now(), window); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if err := f.Check(nonce, time.Now(), window); err != nil {
+		t.Fatalf("nonce after expiry err = %v", err)
+	}
+}
+
+func TestDecryptAESPadding(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	data, err := EncryptAES([]byte("www.example.com:443"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := DecryptAES(append([]byte(nil), data...), key)
+	if err != nil || string(plain) != "www.example.com:443" {
+		t.Fatalf("got %q err %v", plain, err)
+	}
+	if _, err := DecryptAES(data[:len(data)-1], key); err == nil {
+		t.Fatal("partial block accepted")
+	}
+	if _, err := DecryptAES(nil, key); err == nil {
+		t.Fatal("empty data accepted")
+	}
+	// 换key解出来的填充基本不合法，不能panic
+	for i := 0; i < 16; i++ {
+		bad := append([]byte(nil), data...)
+		bad[len(bad)-1] ^= byte(i + 1)
+		DecryptAES(bad, key)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"errors"
 )
 
+// ErrPadding 填充数据不对
+var ErrPadding = errors.New("crypto: invalid padding")
+
 // 填充数据
 func padding(src []byte, blockSize int) []byte {
 	padNum := blockSize - len(src)%blockSize
@@ -14,10 +18,21 @@ func padding(src []byte, blockSize int) []byte {
 }
 
 // 去掉填充数据
-func unpadding(src []byte) []byte {
+func unpadding(src []byte, blockSize int) ([]byte, error) {
 	n := len(src)
+	if n == 0 {
+		return nil, ErrPadding
+	}
 	unPadNum := int(src[n-1])
-	return src[:n-unPadNum]
+	if unPadNum == 0 || unPadNum > blockSize || unPadNum > n {
+		return nil, ErrPadding
+	}
+	for _, b := range src[n-unPadNum:] {
+		if int(b) != unPadNum {
+			return nil, ErrPadding
+		}
+	}
+	return src[:n-unPadNum], nil
 }
 
 // EncryptAES 加密
@@ -38,8 +53,10 @@ func DecryptAES(src []byte, key []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(src) == 0 || len(src)%block.BlockSize() != 0 {
+		return nil, errors.New("crypto: ciphertext is not a multiple of the block size")
+	}
 	blockMode := cipher.NewCBCDecrypter(block, key)
 	blockMode.CryptBlocks(src, src)
-	src = unpadding(src)
-	return src, nil
+	return unpadding(src, block.BlockSize())
 }
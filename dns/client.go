@@ -0,0 +1,424 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultTimeout 单次查询默认超时
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ErrNotFound 域名没有解析记录
+	ErrNotFound = errors.New("dns: no such host")
+	// ErrNoServer 没有可用的服务器
+	ErrNoServer = errors.New("dns: no server")
+)
+
+// Client 一个DNS服务器，支持 udp、tcp、https(DoH)、tls(DoT)
+type Client struct {
+	Name    string
+	scheme  string
+	addr    string // host:port，DoH为完整地址
+	timeout time.Duration
+	http    *http.Client
+	tls     *tls.Config
+}
+
+// ParseAddr 解析服务器地址，不带协议时为udp，udp和tcp默认53端口，tls默认853端口
+func ParseAddr(addr string) (scheme, hostport string, err error) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return
+	}
+	scheme = u.Scheme
+	switch scheme {
+	case "https":
+		if u.Host == "" {
+			err = fmt.Errorf("dns server %s host is empty", addr)
+			return
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return scheme, u.String(), nil
+	case "udp", "tcp", "tls":
+	default:
+		err = fmt.Errorf("dns server scheme %s is not supported", scheme)
+		return
+	}
+	if u.Hostname() == "" {
+		err = fmt.Errorf("dns server %s host is empty", addr)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "53"
+		if scheme == "tls" {
+			port = "853"
+		}
+	}
+	return scheme, net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// NewClient 创建DNS服务器，timeout为0时用默认超时
+func NewClient(name, addr string, timeout time.Duration) (*Client, error) {
+	scheme, hostport, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	c := &Client{Name: name, scheme: scheme, addr: hostport, timeout: timeout}
+	switch scheme {
+	case "https":
+		c.http = &http.Client{Timeout: timeout}
+	case "tls":
+		host, _, _ := net.SplitHostPort(hostport)
+		c.tls = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	return c, nil
+}
+
+// String 日志显示
+func (c *Client) String() string {
+	if c.scheme == "https" {
+		return c.addr
+	}
+	return c.scheme + "://" + c.addr
+}
+
+// LookupIP 同时查询A和AAAA记录，ipv4在前，ttl为记录中最小的有效期
+// 域名不存在时返回ErrNotFound，ttl为SOA中的否定缓存时间，未知时为0
+func (c *Client) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	ch := make(chan result, 2)
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(t dnsmessage.Type) {
+			ips, ttl, err := c.lookup(ctx, host, t)
+			ch <- result{ips, ttl, err}
+		}(t)
+	}
+	var ipv4, ipv6 []net.IP
+	var lastErr error
+	var ttl uint32
+	notFound := 0
+	for i := 0; i < 2; i++ {
+		r := <-ch
+		if r.err == ErrNotFound || (r.err == nil && len(r.ips) == 0) {
+			notFound++
+		} else if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if r.ttl > 0 && (ttl == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		for _, ip := range r.ips {
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, ip)
+			} else {
+				ipv6 = append(ipv6, ip)
+			}
+		}
+	}
+	ips := append(ipv4, ipv6...)
+	if len(ips) > 0 {
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	// A和AAAA都没有记录才算不存在，有一个出错时返回错误不做否定缓存
+	if notFound == 2 {
+		return nil, time.Duration(ttl) * time.Second, ErrNotFound
+	}
+	return nil, 0, lastErr
+}
+
+// lookup 查询一种记录
+func (c *Client) lookup(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	name, err := dnsmessage.NewName(dnsName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+	// ID用不可预测的随机数，防止伪造应答
+	var id uint16
+	// DoH建议ID为0，便于http缓存
+	if c.scheme != "https" {
+		var b [2]byte
+		if _, err = rand.Read(b[:]); err != nil {
+			return nil, 0, err
+		}
+		id = binary.BigEndian.Uint16(b[:])
+	}
+	question := dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := c.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(answer, id, question)
+}
+
+// exchange 按协议发送查询
+func (c *Client) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	switch c.scheme {
+	case "udp":
+		answer, err := c.exchangeUDP(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		// 结果被截断时改用tcp
+		if len(answer) > 2 && answer[2]&0x02 != 0 {
+			return c.exchangeStream(ctx, query)
+		}
+		return answer, nil
+	case "https":
+		return c.exchangeHTTPS(ctx, query)
+	default:
+		return c.exchangeStream(ctx, query)
+	}
+}
+
+// exchangeUDP udp查询
+func (c *Client) exchangeUDP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略ID不符的包
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream tcp和tls查询，消息前带2字节长度
+func (c *Client) exchangeStream(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.tls != nil {
+		conn = tls.Client(conn, c.tls)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, length)
+	if _, err = io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+// exchangeHTTPS DoH查询，RFC 8484 的POST方式
+func (c *Client) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: doh http status %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// parseAnswer 取出A或AAAA记录和最小ttl，CNAME由服务器递归解析
+// 没有记录时ttl取SOA的否定缓存时间，ID和问题与查询不符的丢弃
+func parseAnswer(answer []byte, id uint16, question dnsmessage.Question) (ips []net.IP, ttl uint32, err error) {
+	t := question.Type
+	var p dnsmessage.Parser
+	h, err := p.Start(answer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id {
+		return nil, 0, errors.New("dns: answer id mismatch")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("dns: server error %s", h.RCode)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(questions) != 1 || !sameQuestion(questions[0], question) {
+		return nil, 0, errors.New("dns: answer question mismatch")
+	}
+	for {
+		ah, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case ah.Type == t && t == dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.A[:]))
+		case ah.Type == t && t == dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(r.AAAA[:]))
+		default:
+			if err = p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if ttl == 0 || ah.TTL < ttl {
+			ttl = ah.TTL
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	ttl = negativeTTL(&p)
+	if h.RCode == dnsmessage.RCodeNameError {
+		return nil, ttl, ErrNotFound
+	}
+	return nil, ttl, nil
+}
+
+// negativeTTL 否定缓存时间，取SOA记录ttl和minimum中较小的，RFC 2308
+func negativeTTL(p *dnsmessage.Parser) uint32 {
+	for {
+		ah, err := p.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if ah.Type != dnsmessage.TypeSOA {
+			if p.SkipAuthority() != nil {
+				return 0
+			}
+			continue
+		}
+		r, err := p.SOAResource()
+		if err != nil {
+			return 0
+		}
+		if r.MinTTL < ah.TTL {
+			return r.MinTTL
+		}
+		return ah.TTL
+	}
+}
+
+// dnsName 转为带点结尾的完整域名
+func dnsName(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+// LookupIP 同时向多个服务器查询，先返回结果的生效，都失败时返回最后的错误
+func LookupIP(ctx context.Context, clients []*Client, host string) ([]net.IP, time.Duration, error) {
+	if len(clients) == 0 {
+		return nil, 0, ErrNoServer
+	}
+	if len(clients) == 1 {
+		return clients[0].LookupIP(ctx, host)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	ch := make(chan result, len(clients))
+	for _, c := range clients {
+		go func(c *Client) {
+			ips, ttl, err := c.LookupIP(ctx, host)
+			ch <- result{ips, ttl, err}
+		}(c)
+	}
+	var last result
+	for range clients {
+		r := <-ch
+		if r.err == nil {
+			return r.ips, r.ttl, nil
+		}
+		// 优先返回域名不存在，便于否定缓存
+		if last.err == nil || r.err == ErrNotFound {
+			last = r
+		}
+	}
+	return nil, last.ttl, last.err
+}
+
+// sameQuestion 应答中的问题与查询相同，域名不区分大小写
+func sameQuestion(a, b dnsmessage.Question) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.String(), b.Name.String())
+}
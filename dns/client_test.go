@@ -0,0 +1,334 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer 测试用DNS服务器，udp和tcp监听同一个端口
+// www.example.com 有A和AAAA，big.example.com udp返回截断，nx.example.com 不存在，alias.example.com 只有CNAME
+type testServer struct {
+	addr  string
+	ip    net.IP        // www.example.com 的A记录
+	delay time.Duration // 应答前等待
+	badID bool          // udp先回一个ID不符的包
+
+	udp, tcp int32 // 收到的查询数
+}
+
+func newTestServer(t *testing.T, s *testServer) *testServer {
+	t.Helper()
+	var (
+		ln  net.Listener
+		pc  net.PacketConn
+		err error
+	)
+	// tcp随机端口被udp占用时重试
+	for i := 0; i < 10; i++ {
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if pc, err = net.ListenPacket("udp", ln.Addr().String()); err == nil {
+			break
+		}
+		ln.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		pc.Close()
+	})
+	s.addr = ln.Addr().String()
+	go s.serveUDP(pc)
+	go s.serveTCP(ln)
+	return s
+}
+
+func (s *testServer) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.udp, 1)
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			time.Sleep(s.delay)
+			answer := s.answer(query, true)
+			if s.badID {
+				bad := append([]byte(nil), answer...)
+				bad[0] ^= 0xff
+				pc.WriteTo(bad, addr)
+			}
+			pc.WriteTo(answer, addr)
+		}()
+	}
+}
+
+func (s *testServer) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.tcp, 1)
+		go func() {
+			defer conn.Close()
+			var length uint16
+			if binary.Read(conn, binary.BigEndian, &length) != nil {
+				return
+			}
+			query := make([]byte, length)
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			time.Sleep(s.delay)
+			answer := s.answer(query, false)
+			binary.Write(conn, binary.BigEndian, uint16(len(answer)))
+			conn.Write(answer)
+		}()
+	}
+}
+
+// answer 按域名生成应答
+func (s *testServer) answer(query []byte, udp bool) []byte {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil || len(q.Questions) == 0 {
+		return nil
+	}
+	question := q.Questions[0]
+	h := dnsmessage.Header{ID: q.Header.ID, Response: true, RecursionAvailable: true}
+	name := question.Name.String()
+	switch {
+	case name == "nx.example.com.":
+		h.RCode = dnsmessage.RCodeNameError
+	case name == "big.example.com." && udp:
+		h.Truncated = true
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	rh := func(t dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: question.Name, Type: t, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	switch {
+	case name == "www.example.com." && question.Type == dnsmessage.TypeA:
+		var a [4]byte
+		copy(a[:], s.ip.To4())
+		b.AResource(rh(dnsmessage.TypeA, 300), dnsmessage.AResource{A: a})
+		b.AResource(rh(dnsmessage.TypeA, 200), dnsmessage.AResource{A: [4]byte{5, 6, 7, 8}})
+	case name == "www.example.com." && question.Type == dnsmessage.TypeAAAA:
+		b.AAAAResource(rh(dnsmessage.TypeAAAA, 100), dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}})
+	case name == "big.example.com." && question.Type == dnsmessage.TypeA && !udp:
+		b.AResource(rh(dnsmessage.TypeA, 60), dnsmessage.AResource{A: [4]byte{9, 9, 9, 9}})
+	case name == "alias.example.com.":
+		b.CNAMEResource(rh(dnsmessage.TypeCNAME, 30), dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("target.example.com.")})
+	}
+	if name == "nx.example.com." || name == "alias.example.com." {
+		b.StartAuthorities()
+		b.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 600},
+			dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("admin.example.com."), MinTTL: 60})
+	}
+	data, _ := b.Finish()
+	return data
+}
+
+func newTestClient(t *testing.T, addr string) *Client {
+	t.Helper()
+	c, err := NewClient("test", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientUDP(t *testing.T) {
+	s := newTestServer(t, &testServer{ip: net.ParseIP("1.2.3.4")})
+	c := newTestClient(t, s.addr)
+	ips, ttl, err := c.LookupIP(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 || !ips[0].Equal(net.ParseIP("1.2.3.4")) || !ips[1].Equal(net.ParseIP("5.6.7.8")) || !ips[2].Equal(net.ParseIP("::1")) {
+		t.Fatalf("ips = %v", ips)
+	}
+	if ttl != 100*time.Second {
+		t.Fatalf("ttl = %v, want min ttl 100s", ttl)
+	}
+	if atomic.LoadInt32(&s.tcp) != 0 {
+		t.Fatal("udp query fell back to tcp")
+	}
+}
+
+func TestClientUDPTruncated(t *testing.T) {
+	s := newTestServer(t, &testServer{ip: net.ParseIP("1.2.3.4")})
+	c := newTestClient(t, "udp://"+s.addr)
+	ips, ttl, err := c.LookupIP(context.Background(), "big.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("9.9.9.9")) || ttl != 60*time.Second {
+		t.Fatalf("ips = %v ttl = %v", ips, ttl)
+	}
+	if n := atomic.LoadInt32(&s.tcp); n != 2 {
+		t.Fatalf("tcp queries = %d, want 2 after truncation", n)
+	}
+}
+
+func TestClientUDPIgnoreBadID(t *testing.T) {
+	s := newTestServer(t, &testServer{ip: net.ParseIP("1.2.3.4"), badID: true})
+	c := newTestClient(t, s.addr)
+	ips, _, err := c.LookupIP(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 {
+		t.Fatalf("ips = %v", ips)
+	}
+}
+
+func TestClientTCP(t *testing.T) {
+	s := newTestServer(t, &testServer{ip: net.ParseIP("1.2.3.4")})
+	c := newTestClient(t, "tcp://"+s.addr)
+	ips, _, err := c.LookupIP(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 || !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("ips = %v", ips)
+	}
+	if atomic.LoadInt32(&s.udp) != 0 {
+		t.Fatal("tcp client sent udp query")
+	}
+
+	_, ttl, err := c.LookupIP(context.Background(), "nx.example.com")
+	if err != ErrNotFound || ttl != 60*time.Second {
+		t.Fatalf("nx err = %v ttl = %v", err, ttl)
+	}
+}
+
+func TestClientDoH(t *testing.T) {
+	s := &testServer{ip: net.ParseIP("1.2.3.4")}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		// DoH查询ID为0
+		if len(query) < 2 || query[0] != 0 || query[1] != 0 {
+			http.Error(w, "bad id", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(s.answer(query, false))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv.URL)
+	c.http = srv.Client()
+	ips, ttl, err := c.LookupIP(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 3 || ttl != 100*time.Second {
+		t.Fatalf("ips = %v ttl = %v", ips, ttl)
+	}
+
+	c = newTestClient(t, srv.URL+"/other")
+	c.http = srv.Client()
+	if _, _, err := c.LookupIP(context.Background(), "www.example.com"); err == nil {
+		t.Fatal("http error not returned")
+	}
+}
+
+func TestParseAnswer(t *testing.T) {
+	s := &testServer{ip: net.ParseIP("1.2.3.4")}
+	question := func(name string) dnsmessage.Question {
+		return dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	}
+	query := func(q dnsmessage.Question, id uint16) []byte {
+		msg := dnsmessage.Message{Header: dnsmessage.Header{ID: id}, Questions: []dnsmessage.Question{q}}
+		data, _ := msg.Pack()
+		return data
+	}
+
+	// 域名不存在，ttl取SOA的ttl和minimum中较小的
+	nx := question("nx.example.com.")
+	ips, ttl, err := parseAnswer(s.answer(query(nx, 7), false), 7, nx)
+	if err != ErrNotFound || ips != nil || ttl != 60 {
+		t.Fatalf("nxdomain ips = %v ttl = %d err = %v", ips, ttl, err)
+	}
+
+	// 只有CNAME没有A记录不算错误，ttl同样取SOA
+	alias := question("alias.example.com.")
+	ips, ttl, err = parseAnswer(s.answer(query(alias, 8), false), 8, alias)
+	if err != nil || len(ips) != 0 || ttl != 60 {
+		t.Fatalf("cname only ips = %v ttl = %d err = %v", ips, ttl, err)
+	}
+
+	// 域名大小写不同仍是同一问题
+	www := question("www.example.com.")
+	if _, _, err = parseAnswer(s.answer(query(question("WWW.Example.com."), 9), false), 9, www); err != nil {
+		t.Fatalf("case insensitive err = %v", err)
+	}
+
+	if _, _, err = parseAnswer(s.answer(query(www, 9), false), 10, www); err == nil {
+		t.Fatal("id mismatch accepted")
+	}
+	// 问题的域名、类型、类别与查询不符的丢弃
+	aaaa, chaos := www, www
+	aaaa.Type = dnsmessage.TypeAAAA
+	chaos.Class = dnsmessage.ClassCHAOS
+	for _, q := range []dnsmessage.Question{question("evil.example.com."), aaaa, chaos} {
+		if _, _, err = parseAnswer(s.answer(query(q, 11), false), 11, www); err == nil {
+			t.Fatalf("question %v accepted for %v", q, www)
+		}
+	}
+	if _, _, err = parseAnswer([]byte{0, 1, 2}, 0, www); err == nil {
+		t.Fatal("short answer accepted")
+	}
+}
+
+func TestLookupIPFirstAnswerWins(t *testing.T) {
+	slow := newTestServer(t, &testServer{ip: net.ParseIP("9.9.9.9"), delay: 500 * time.Millisecond})
+	fast := newTestServer(t, &testServer{ip: net.ParseIP("1.2.3.4")})
+	clients := []*Client{newTestClient(t, slow.addr), newTestClient(t, fast.addr)}
+
+	start := time.Now()
+	ips, _, err := LookupIP(context.Background(), clients, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ips[0].Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("ips = %v, want answer of the fast server", ips)
+	}
+	if elapsed := time.Since(start); elapsed >= slow.delay {
+		t.Fatalf("waited %v for the slow server", elapsed)
+	}
+
+	// 都失败时优先返回域名不存在
+	dead := newTestClient(t, "127.0.0.1:1")
+	_, ttl, err := LookupIP(context.Background(), []*Client{dead, clients[1]}, "nx.example.com")
+	if err != ErrNotFound || ttl != 60*time.Second {
+		t.Fatalf("err = %v ttl = %v", err, ttl)
+	}
+
+	if _, _, err = LookupIP(context.Background(), nil, "www.example.com"); err != ErrNoServer {
+		t.Fatalf("no clients err = %v", err)
+	}
+}
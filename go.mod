@@ -9,6 +9,7 @@ require (
 	github.com/gorilla/websocket v1.4.2
 	golang.org/x/net v0.36.0
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/sys v0.30.0 // indirect
@@ -38,6 +38,7 @@ type Server struct {
 
 	mu         sync.Mutex
 	activeConn map[*conn]struct{}
+	lnMu       sync.Mutex // 保护ln，监听地址热加载时替换
 }
 
 // Serve accepts incoming connections on the Listener l,
@@ -53,7 +54,7 @@ func (srv *Server) Serve() (err error) {
 		return err
 	}
 
-	log.Println(syscall.Getpid(), srv.ln.Addr(), "Listener closed.")
+	log.Println(syscall.Getpid(), srv.listener().Addr(), "Listener closed.")
 	// wait for Shutdown to return
 	return <-srv.terminalChan
 }
@@ -92,8 +93,13 @@ func (srv *Server) serve() (err error) {
 	ctx := context.WithValue(baseCtx, ServerContextKey, srv)
 	for {
 		var rw *net.TCPConn
-		rw, err = srv.ln.AcceptTCP()
+		ln := srv.listener()
+		rw, err = ln.AcceptTCP()
 		if err != nil {
+			// 监听地址已替换，旧的监听关闭
+			if srv.listener() != ln {
+				continue
+			}
 			// 主动重启服务
 			if srv.state == StateShuttingDown && strings.Contains(err.Error(), "use of closed network connection") {
 				return ErrReloadClose
@@ -120,6 +126,53 @@ func (srv *Server) serve() (err error) {
 	}
 }
 
+// listener 当前的监听
+func (srv *Server) listener() *net.TCPListener {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+	return srv.ln
+}
+
+// Rebind 监听新的地址并关闭旧的监听，已接收的连接不受影响
+func (srv *Server) Rebind(addr, network string) error {
+	regLock.Lock()
+	defer regLock.Unlock()
+	if network == "" {
+		network = srv.Network
+	}
+	lnaddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen error: %v", err)
+	}
+	ln, err := net.ListenTCP(network, lnaddr)
+	if err != nil {
+		return fmt.Errorf("net.Listen error: %v", err)
+	}
+
+	// 平滑重启按地址传递监听的fd，这里同步替换
+	offset := socketPtrOffsetMap[srv.Addr]
+	delete(runningServers, srv.Addr)
+	delete(socketPtrOffsetMap, srv.Addr)
+	for i, a := range runningServersOrder {
+		if a == srv.Addr {
+			runningServersOrder[i] = addr
+		}
+	}
+	runningServers[addr] = srv
+	socketPtrOffsetMap[addr] = offset
+
+	srv.lnMu.Lock()
+	old := srv.ln
+	srv.ln = ln
+	srv.Addr, srv.Network = addr, network
+	srv.lnMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	log.Println(fmt.Sprintf("Listening for connections on %v, pid=%d", ln.Addr(), os.Getpid()))
+	return nil
+}
+
 // closeIdleConns closes all idle connections and reports whether the
 // server is quiescent.
 func (srv *Server) closeIdleConns() bool {
@@ -161,6 +214,19 @@ func (srv *Server) GetConnRange(f func(ID uint, startTime int64, remoteAddr stri
 	}
 }
 
+// CloseConn 按traceID关闭连接，不存在时返回false
+func (srv *Server) CloseConn(ID uint) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.activeConn {
+		if c.traceID == ID {
+			c.rwc.Close()
+			return true
+		}
+	}
+	return false
+}
+
 // 统计连接数
 func (srv *Server) trackConn(c *conn, add bool) {
 	srv.mu.Lock()
@@ -194,11 +260,14 @@ func (srv *Server) ListenAndServe() (err error) {
 
 	go srv.handleSignals()
 
-	srv.ln, err = srv.getListener(addr)
+	ln, err := srv.getListener(addr)
 	if err != nil {
 		log.Println(os.Getpid(), err)
 		return err
 	}
+	srv.lnMu.Lock()
+	srv.ln = ln
+	srv.lnMu.Unlock()
 
 	ppid := os.Getppid()
 	if srv.isChild && ppid != 1 { //增加一个安全检查
@@ -213,7 +282,7 @@ func (srv *Server) ListenAndServe() (err error) {
 		}
 	}
 
-	log.Println(fmt.Sprintf("Listening for connections on %v, pid=%d", srv.ln.Addr(), os.Getpid()))
+	log.Println(fmt.Sprintf("Listening for connections on %v, pid=%d", ln.Addr(), os.Getpid()))
 
 	return srv.Serve()
 }
@@ -310,7 +379,7 @@ func (srv *Server) shutdown(timeout int) {
 	srv.state = StateShuttingDown
 	// listen close就不能accept新的链接，已接收的链接不受影响
 	// 关闭已连接的是用tcpConn.Close(), 为了简单下面是用超时来等待处理
-	srv.ln.Close()
+	srv.listener().Close()
 
 	if timeout > 0 {
 		log.Println(syscall.Getpid(), fmt.Sprintf("Waiting max %d second for connections to finish...", timeout))
@@ -352,7 +421,7 @@ func (srv *Server) fork() (err error) {
 	var files = make([]*os.File, len(runningServers))
 	var orderArgs = make([]string, len(runningServers))
 	for _, srvPtr := range runningServers {
-		f, _ := srvPtr.ln.File()
+		f, _ := srvPtr.listener().File()
 		files[socketPtrOffsetMap[srvPtr.Addr]] = f
 		orderArgs[socketPtrOffsetMap[srvPtr.Addr]] = srvPtr.Addr
 	}
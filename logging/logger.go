@@ -6,11 +6,18 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/keminar/anyproxy/config"
 )
 
-// SetDefaultLogger 设置日志
+// defaultWriter 当前的日志文件，重新设置后关闭
+var (
+	defaultMu     sync.Mutex
+	defaultWriter *TimeWriter
+)
+
+// SetDefaultLogger 设置日志，日志目录热加载后可再次调用
 func SetDefaultLogger(dir, prefix string, compress bool, reserveDay int, w io.Writer) {
 	timeWriter := &TimeWriter{
 		Dir:        dir,
@@ -26,6 +33,13 @@ func SetDefaultLogger(dir, prefix string, compress bool, reserveDay int, w io.Wr
 		writers = append(writers, w)
 	}
 	log.SetOutput(io.MultiWriter(writers...))
+	defaultMu.Lock()
+	old := defaultWriter
+	defaultWriter = timeWriter
+	defaultMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
 	switch config.DebugLevel {
 	case config.LevelLong:
 		log.SetFlags(log.Lshortfile | log.Ldate | log.Lmicroseconds)
@@ -21,6 +21,9 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// 管理接口查询订阅者列表
+	list chan chan []ClientInfo
 }
 
 func newHub() *Hub {
@@ -29,6 +32,7 @@ func newHub() *Hub {
 		broadcast:  make(chan *CMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		list:       make(chan chan []ClientInfo),
 		clients:    make(map[*Client]bool),
 	}
 }
@@ -44,6 +48,12 @@ func (h *Hub) run() {
 				delete(h.clients, client)
 				log.Printf("client email %s disconnected, total client nums %d\n", client.Email, len(h.clients))
 			}
+		case ch := <-h.list:
+			list := make([]ClientInfo, 0, len(h.clients))
+			for client := range h.clients {
+				list = append(list, client.info())
+			}
+			ch <- list
 		case cmessage := <-h.broadcast:
 			if config.DebugLevel >= config.LevelDebug {
 				log.Println("client nums", len(h.clients))
@@ -85,3 +95,36 @@ func (h *Hub) GetClient(header http.Header) *Client {
 	}
 	return nil
 }
+
+// ClientInfo 订阅者信息，管理接口显示
+type ClientInfo struct {
+	User       string          `json:"user"`
+	Email      string          `json:"email"`
+	RemoteAddr string          `json:"remoteAddr"`
+	Subscribe  []SubscribeInfo `json:"subscribe"`
+}
+
+// SubscribeInfo 订阅特征
+type SubscribeInfo struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+}
+
+// info 订阅者信息，注册后不再修改
+func (c *Client) info() ClientInfo {
+	ci := ClientInfo{User: c.User, Email: c.Email, RemoteAddr: c.conn.RemoteAddr().String(), Subscribe: []SubscribeInfo{}}
+	for _, s := range c.Subscribe {
+		ci.Subscribe = append(ci.Subscribe, SubscribeInfo{Key: s.Key, Val: s.Val})
+	}
+	return ci
+}
+
+// Clients 服务端已连接的订阅者，未开启服务时为空，通过hub查询保证并发安全
+func Clients() []ClientInfo {
+	if !serverStart {
+		return []ClientInfo{}
+	}
+	ch := make(chan []ClientInfo)
+	ServerHub.list <- ch
+	return <-ch
+}
@@ -107,13 +107,14 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		conn.WriteMessage(websocket.TextMessage, []byte("xtime err, please check local time"))
 		return
 	}
-	if user.User != conf.RouterConfig.Websocket.User {
+	ws := conf.Current().Websocket
+	if user.User != ws.User {
 		log.Printf("serveWs client email %s ignore, user is error\n", user.Email)
 		conn.WriteMessage(websocket.TextMessage, []byte("user err"))
 		return
 	}
 
-	token, err := tools.Md5Str(fmt.Sprintf("%s|%s|%d", user.User, conf.RouterConfig.Websocket.Pass, user.Xtime))
+	token, err := tools.Md5Str(fmt.Sprintf("%s|%s|%d", user.User, ws.Pass, user.Xtime))
 	if err != nil || user.Token != token {
 		log.Printf("serveWs client email %s ignore, token is error\n", user.Email)
 		conn.WriteMessage(websocket.TextMessage, []byte("token err"))
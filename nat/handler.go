@@ -11,7 +11,9 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/keminar/anyproxy/utils/conf"
@@ -29,38 +31,90 @@ var LocalBridge *BridgeHub
 
 var tempDelay time.Duration
 
+var (
+	clientMu      sync.Mutex
+	clientAddr    string // 当前连接的服务端地址，为空时断开
+	clientRunning bool
+	clientOnce    sync.Once
+	// reconnect 配置变化后断开当前连接，用新配置重连
+	reconnect = make(chan struct{}, 1)
+)
+
 // ConnectServer 连接到websocket服务
 func ConnectServer(addr *string) {
-	if conf.RouterConfig.Websocket.User == "" || conf.RouterConfig.Websocket.Email == "" {
-		log.Println("ws user or email empty, donot connect")
+	clientMu.Lock()
+	if clientRunning {
+		clientMu.Unlock()
 		return
 	}
+	clientAddr = *addr
+	clientRunning = true
+	clientMu.Unlock()
+	defer func() {
+		clientMu.Lock()
+		clientRunning = false
+		clientMu.Unlock()
+	}()
+
 	interruptClose = false
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
 
-	ClientHub = newHub()
-	go ClientHub.run()
-	LocalBridge = newBridgeHub()
-	go LocalBridge.run()
+	clientOnce.Do(func() {
+		ClientHub = newHub()
+		go ClientHub.run()
+		LocalBridge = newBridgeHub()
+		go LocalBridge.run()
+	})
 
-	addrs := strings.Split(*addr, "://")
-	if addrs[0] == "ws" && len(addrs) == 2 {
-		*addr = addrs[1]
-	}
 	for {
-		connect(addr, interrupt)
+		clientMu.Lock()
+		addr := clientAddr
+		clientMu.Unlock()
+		if addr == "" {
+			log.Println("ws connect addr is empty, disconnect")
+			break
+		}
+		ws := conf.Current().Websocket
+		if ws.User == "" || ws.Email == "" {
+			log.Println("ws user or email empty, donot connect")
+			break
+		}
+		addrs := strings.Split(addr, "://")
+		if addrs[0] == "ws" && len(addrs) == 2 {
+			addr = addrs[1]
+		}
+		connect(&addr, interrupt)
 		if interruptClose {
 			break
 		}
 	}
 }
 
+// ReloadClient 配置变化后用新地址和认证信息重连，addr为空时断开
+func ReloadClient(addr string) {
+	clientMu.Lock()
+	clientAddr = addr
+	running := clientRunning
+	clientMu.Unlock()
+	if !running {
+		if addr != "" {
+			go ConnectServer(&addr)
+		}
+		return
+	}
+	select {
+	case reconnect <- struct{}{}:
+	default:
+	}
+}
+
 // 连接本地Proxy服务
 func dialProxy() net.Conn {
 	connTimeout := time.Duration(5) * time.Second
 	var err error
-	localProxy := fmt.Sprintf("%s:%d", "127.0.0.1", config.ListenPort)
+	localProxy := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(config.ListenPort())))
 	proxyConn, err := net.DialTimeout("tcp", localProxy, connTimeout)
 	if err != nil {
 		log.Println("dial local proxy", err)
@@ -71,12 +125,18 @@ func dialProxy() net.Conn {
 
 // 认证连接并交换数据
 func connect(addr *string, interrupt chan os.Signal) {
+	// 连接前的重连通知已用最新配置，不再处理
+	select {
+	case <-reconnect:
+	default:
+	}
 	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ws"}
 	log.Printf("connecting to %s", u.String())
 
+	ws := conf.Current().Websocket
 	h := http.Header{}
-	if conf.RouterConfig.Websocket.Host != "" {
-		h.Add("Host", conf.RouterConfig.Websocket.Host)
+	if ws.Host != "" {
+		h.Add("Host", ws.Host)
 	}
 	c, _, err := websocket.DefaultDialer.Dial(u.String(), h)
 	if err != nil {
@@ -87,7 +147,7 @@ func connect(addr *string, interrupt chan os.Signal) {
 	defer c.Close()
 
 	w := newClientHandler(c)
-	err = w.auth(conf.RouterConfig.Websocket.User, conf.RouterConfig.Websocket.Pass, conf.RouterConfig.Websocket.Email)
+	err = w.auth(ws.User, ws.Pass, ws.Email)
 	if err != nil {
 		log.Println("auth:", err)
 
@@ -103,7 +163,7 @@ func connect(addr *string, interrupt chan os.Signal) {
 		return
 	}
 	tempDelay = 0
-	err = w.subscribe(conf.RouterConfig.Websocket.Subscribe)
+	err = w.subscribe(ws.Subscribe)
 	if err != nil {
 		log.Println("subscribe:", err)
 		time.Sleep(time.Duration(3) * time.Second)
@@ -128,6 +188,10 @@ func connect(addr *string, interrupt chan os.Signal) {
 		select {
 		case <-done:
 			return
+		case <-reconnect:
+			log.Println("websocket config changed, reconnect")
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
 		case <-interrupt:
 			log.Println("interrupt")
 			interruptClose = true
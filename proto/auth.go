@@ -0,0 +1,28 @@
+package proto
+
+import (
+	"crypto/subtle"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// checkUser 校验用户名密码
+func checkUser(users []conf.User, name, pass string) bool {
+	for _, u := range users {
+		if u.Name != name {
+			continue
+		}
+		return subtle.ConstantTimeCompare([]byte(u.Pass), []byte(pass)) == 1
+	}
+	return false
+}
+
+// inStrings 检查是否在列表中
+func inStrings(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
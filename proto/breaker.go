@@ -0,0 +1,197 @@
+package proto
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	defaultBreakerFailures = 3
+	defaultBreakerCooldown = 60 * time.Second
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// breakerConf 熔断设置
+type breakerConf struct {
+	failures int
+	cooldown time.Duration
+}
+
+// getBreakerConf 取配置，为0用默认值
+func getBreakerConf(cnf *conf.Router) breakerConf {
+	bc := breakerConf{failures: defaultBreakerFailures, cooldown: defaultBreakerCooldown}
+	if cnf != nil && cnf.Breaker.Failures > 0 {
+		bc.failures = cnf.Breaker.Failures
+	}
+	if cnf != nil && cnf.Breaker.Cooldown > 0 {
+		bc.cooldown = time.Duration(cnf.Breaker.Cooldown) * time.Second
+	}
+	return bc
+}
+
+// breaker 熔断器，连续失败达到次数后打开，冷却后半开放行请求试探，成功关闭失败再打开
+type breaker struct {
+	mu       sync.Mutex
+	name     string
+	state    int
+	failures int // 连续失败次数
+	openedAt time.Time
+	lastFail time.Time
+	trialAt  time.Time // 半开时放行的试探请求开始时间，为零时没有试探
+}
+
+// ready 是否可以使用，半开时只放行一个试探请求，直到报告成功或失败
+func (b *breaker) ready(bc breakerConf) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.check(bc) {
+		return false
+	}
+	if b.state == breakerHalfOpen {
+		b.trialAt = time.Now()
+	}
+	return true
+}
+
+// available 是否可以使用，不占用半开的试探机会
+func (b *breaker) available(bc breakerConf) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.check(bc)
+}
+
+// check 打开后冷却时间已过转为半开，试探请求超过冷却时间没有结果时再放行一个，调用方持有锁
+func (b *breaker) check(bc breakerConf) bool {
+	if b.state == breakerOpen && time.Since(b.openedAt) >= bc.cooldown {
+		b.setState(breakerHalfOpen)
+		b.trialAt = time.Time{}
+	}
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return b.trialAt.IsZero() || time.Since(b.trialAt) >= bc.cooldown
+	}
+	return true
+}
+
+// success 成功后关闭
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trialAt = time.Time{}
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// failure 记录失败，半开时或连续失败达到次数时打开
+func (b *breaker) failure(bc breakerConf) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastFail = time.Now()
+	b.trialAt = time.Time{}
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= bc.failures) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState 调用方持有锁
+func (b *breaker) setState(state int) {
+	log.Println("breaker", b.name, breakerStates[b.state], "->", breakerStates[state], "failures", b.failures)
+	b.state = state
+}
+
+// status 状态名称和连续失败次数
+func (b *breaker) status() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return breakerStates[b.state], b.failures
+}
+
+// addrBreakers auto直连的ip地址熔断器，只保存失败过的地址
+var (
+	addrBreakers  sync.Map // ip -> *breaker
+	addrFailCount uint32
+)
+
+// addrReady ip地址是否可以直连，只用于地址排序，不可用的地址最后仍会尝试，不占用试探机会
+func addrReady(addr string, bc breakerConf) bool {
+	if v, ok := addrBreakers.Load(addr); ok {
+		return v.(*breaker).available(bc)
+	}
+	return true
+}
+
+// addrSuccess 直连成功后删除熔断器
+func addrSuccess(addr string) {
+	if v, ok := addrBreakers.Load(addr); ok {
+		v.(*breaker).success()
+		addrBreakers.Delete(addr)
+	}
+}
+
+// addrFailure 记录直连失败，定期清理很久没再失败的地址
+func addrFailure(addr string, bc breakerConf) {
+	v, _ := addrBreakers.LoadOrStore(addr, &breaker{name: addr})
+	v.(*breaker).failure(bc)
+	if atomic.AddUint32(&addrFailCount, 1)%1000 == 0 {
+		addrBreakers.Range(func(key, v interface{}) bool {
+			b := v.(*breaker)
+			b.mu.Lock()
+			stale := time.Since(b.lastFail) > 10*bc.cooldown
+			b.mu.Unlock()
+			if stale {
+				addrBreakers.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// upstreamFault 是否为代理本身的故障，连接失败、断开、超时和5xx记入熔断
+// 规则禁止和代理返回的403、407等应答说明代理可用，不记入
+func upstreamFault(err error) bool {
+	var deny denyError
+	if errors.As(err, &deny) {
+		return false
+	}
+	var resp *proxyRespError
+	if errors.As(err, &resp) {
+		return resp.code == 0 || resp.code >= 500
+	}
+	return true
+}
+
+// BreakerStatus 熔断器状态
+type BreakerStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"` // 连续失败次数
+}
+
+// AddrBreakers 直连地址中失败过的熔断器
+func AddrBreakers() []BreakerStatus {
+	list := []BreakerStatus{}
+	addrBreakers.Range(func(key, v interface{}) bool {
+		state, failures := v.(*breaker).status()
+		list = append(list, BreakerStatus{Name: key.(string), State: state, Failures: failures})
+		return true
+	})
+	return list
+}
@@ -0,0 +1,235 @@
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+func TestBreakerHalfOpenSingleTrial(t *testing.T) {
+	bc := breakerConf{failures: 2, cooldown: 50 * time.Millisecond}
+	b := &breaker{name: "test"}
+	b.failure(bc)
+	if !b.ready(bc) {
+		t.Fatal("opened before reaching failures")
+	}
+	b.failure(bc)
+	if b.ready(bc) || b.available(bc) {
+		t.Fatal("not opened after failures")
+	}
+
+	// 冷却后只放行一个试探请求
+	time.Sleep(60 * time.Millisecond)
+	if !b.available(bc) || !b.available(bc) {
+		t.Fatal("available should not take the trial")
+	}
+	if !b.ready(bc) {
+		t.Fatal("trial not allowed after cooldown")
+	}
+	if b.ready(bc) || b.available(bc) {
+		t.Fatal("second trial allowed while first in flight")
+	}
+
+	// 试探失败再打开
+	b.failure(bc)
+	if state, _ := b.status(); state != "open" || b.ready(bc) {
+		t.Fatalf("state after failed trial = %s", state)
+	}
+
+	// 试探一直没有结果时，冷却时间后再放行一个
+	time.Sleep(60 * time.Millisecond)
+	if !b.ready(bc) || b.ready(bc) {
+		t.Fatal("trial not single")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !b.ready(bc) {
+		t.Fatal("stale trial blocks breaker")
+	}
+
+	// 试探成功后关闭，不再限制
+	b.success()
+	if state, failures := b.status(); state != "closed" || failures != 0 {
+		t.Fatalf("state after success = %s %d", state, failures)
+	}
+	if !b.ready(bc) || !b.ready(bc) {
+		t.Fatal("closed breaker limits requests")
+	}
+}
+
+func TestUpstreamFault(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{denyError("deny"), false},
+		{fmt.Errorf("wrap: %w", denyError("deny")), false},
+		{&proxyRespError{code: 403, status: "HTTP/1.1 403 Forbidden"}, false},
+		{&proxyRespError{code: 407, status: "HTTP/1.1 407 Proxy Authentication Required"}, false},
+		{&proxyRespError{code: 502, status: "HTTP/1.1 502 Bad Gateway"}, true},
+		{&proxyRespError{status: "garbage"}, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+	}
+	for _, tt := range tests {
+		if got := upstreamFault(tt.err); got != tt.want {
+			t.Errorf("upstreamFault(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPickHalfOpen(t *testing.T) {
+	bc := breakerConf{failures: 1, cooldown: 20 * time.Millisecond}
+	g := newUpstreamGroup("test", conf.Upstream{Name: "test", Proxies: []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}})
+	m0, m1 := g.members[0], g.members[1]
+	m0.brk.failure(bc)
+	time.Sleep(30 * time.Millisecond)
+
+	// 半开的代理只给第一个请求，其它请求选下一个
+	if m := g.pick("", bc, nil); m != m0 {
+		t.Fatal("half-open member not picked for trial")
+	}
+	for i := 0; i < 3; i++ {
+		if m := g.pick("", bc, nil); m != m1 {
+			t.Fatal("half-open member picked twice")
+		}
+	}
+	m1.brk.failure(bc)
+	if m := g.pick("", bc, nil); m != nil {
+		t.Fatalf("picked %s with all members unavailable", m.name())
+	}
+}
+
+func TestCandidateKeepsTrial(t *testing.T) {
+	bc := breakerConf{failures: 1, cooldown: 20 * time.Millisecond}
+	g := newUpstreamGroup("test", conf.Upstream{Name: "test", Proxies: []string{"http://127.0.0.1:1", "http://127.0.0.1:2"}})
+	m0, m1 := g.members[0], g.members[1]
+	m0.brk.failure(bc)
+	time.Sleep(30 * time.Millisecond)
+
+	// route 和 route explain 只查看，多次查看后试探机会还在
+	s := &tunnel{req: &Request{cnf: &conf.Router{}}}
+	for i := 0; i < 3; i++ {
+		if m := g.candidate("", bc, nil); m != m0 {
+			t.Fatal("candidate skipped half-open member")
+		}
+	}
+	s.group, s.member = g, m0
+	up, err := s.claimProxy(conf.Host{Token: "tk"}, "", m0.up)
+	if err != nil || s.member != m0 || up.addr() != m0.up.addr() {
+		t.Fatalf("claim err %v member %s", err, s.member.name())
+	}
+
+	// 试探机会已被占用，连接前换下一个
+	s2 := &tunnel{req: s.req, group: g, member: m0}
+	up, err = s2.claimProxy(conf.Host{Token: "tk"}, "", m0.up)
+	if err != nil || s2.member != m1 || up.addr() != m1.up.addr() || up.token != "tk" {
+		t.Fatalf("claim err %v member %s", err, s2.member.name())
+	}
+}
+
+// connectServer 对CONNECT请求返回指定的状态，返回地址和连接次数
+func connectServer(t *testing.T, status string) (string, *int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var n int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&n, 1)
+			go func() {
+				defer conn.Close()
+				bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "HTTP/1.1 %s\r\n\r\n", status)
+			}()
+		}
+	}()
+	return ln.Addr().String(), &n
+}
+
+func TestRetryViaFaults(t *testing.T) {
+	tests := []struct {
+		status   string
+		conns    int32
+		failures int
+	}{
+		{"403 Forbidden", 1, 0},
+		{"502 Bad Gateway", 2, 2},
+	}
+	for _, tt := range tests {
+		addr, n := connectServer(t, tt.status)
+		g := newUpstreamGroup("test", conf.Upstream{Name: "test", Proxies: []string{"http://" + addr}})
+		s := &tunnel{req: &Request{cnf: &conf.Router{}}}
+		s.group, s.member = g, g.members[0]
+		err := s.connectVia("", s.member.up, "tcp", "example.com:443")
+		err = s.retryVia("", conf.Host{}, "example.com", "tcp", "example.com:443", err)
+		var resp *proxyRespError
+		if !errors.As(err, &resp) || strconv.Itoa(resp.code) != tt.status[:3] {
+			t.Fatalf("%s: err = %v", tt.status, err)
+		}
+		if got := atomic.LoadInt32(n); got != tt.conns {
+			t.Errorf("%s: proxy connections = %d, want %d", tt.status, got, tt.conns)
+		}
+		if _, failures := g.members[0].brk.status(); failures != tt.failures {
+			t.Errorf("%s: breaker failures = %d, want %d", tt.status, failures, tt.failures)
+		}
+	}
+}
+
+func TestDefaultGroup(t *testing.T) {
+	defer config.SetProxyServer("")
+	config.SetProxyServer("")
+	if g := defaultGroup(); g != nil {
+		t.Fatal("default group without proxy")
+	}
+	config.SetProxyServer("tunnel://127.0.0.1:3000")
+	g := defaultGroup()
+	if g == nil || len(g.members) != 1 || g.members[0].up.addr() != "127.0.0.1:3000" {
+		t.Fatal("default group not built")
+	}
+	if defaultGroup() != g {
+		t.Fatal("default group rebuilt without change")
+	}
+	config.SetProxyServer("socks5://127.0.0.1:1080")
+	if g2 := defaultGroup(); g2 == g || g2.members[0].name() != "socks5://127.0.0.1:1080" {
+		t.Fatal("default group not rebuilt after proxy change")
+	}
+}
+
+func TestFindGroupKeepsState(t *testing.T) {
+	defer syncUpstreams(&conf.Router{})
+	cnf := &conf.Router{}
+	host := conf.Host{Name: "example.com", Proxy: "http://127.0.0.1:1"}
+	g := findGroup(cnf, host)
+	if g == nil {
+		t.Fatal("group not found")
+	}
+	// 同步时没有登记的也只建一次，熔断状态保留
+	if findGroup(cnf, host) != g {
+		t.Fatal("group rebuilt on every lookup")
+	}
+	syncUpstreams(cnf)
+	select {
+	case <-g.stop:
+	default:
+		t.Fatal("unused group not stopped on sync")
+	}
+	if findGroup(cnf, host) == g {
+		t.Fatal("stopped group reused")
+	}
+}
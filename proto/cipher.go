@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/keminar/anyproxy/crypto"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// 新版CONNECT目标地址前缀, 旧版是标准base64不会出现"."
+const tunnelPrefix = "v1."
+
+// 防重放默认时间窗口秒数
+const defaultTunnelWindow = 60
+
+var replayFilter = crypto.NewReplayFilter()
+
+// encryptTarget 用指定密钥加密CONNECT的目标地址
+func encryptTarget(target string, token string) (string, error) {
+	x1, err := crypto.SealTarget([]byte(target), crypto.DeriveKey(token), time.Now())
+	if err != nil {
+		return "", err
+	}
+	return tunnelPrefix + base64.RawURLEncoding.EncodeToString(x1), nil
+}
+
+// serverTokens 服务端可用的密钥，配置了命名密钥时全局token不再生效
+func serverTokens(cnf *conf.Router) []conf.TunnelToken {
+	if len(cnf.Tunnel.Tokens) > 0 {
+		return cnf.Tunnel.Tokens
+	}
+	return []conf.TunnelToken{{Token: getToken(cnf)}}
+}
+
+// decryptTarget 解密CONNECT的目标地址，并检查重放, 同时返回解密成功的密钥
+func decryptTarget(uri string, cnf *conf.Router) (string, conf.TunnelToken, error) {
+	if !strings.HasPrefix(uri, tunnelPrefix) {
+		if !cnf.Tunnel.Legacy {
+			return "", conf.TunnelToken{}, badRequestError("legacy tunnel request is disabled")
+		}
+		return decryptLegacyTarget(uri, cnf)
+	}
+	x1, err := base64.RawURLEncoding.DecodeString(uri[len(tunnelPrefix):])
+	if err != nil {
+		return "", conf.TunnelToken{}, err
+	}
+	// GCM带认证，密钥不对必然解密失败，逐个尝试即可
+	for _, tk := range serverTokens(cnf) {
+		target, ts, nonce, err := crypto.OpenTarget(x1, crypto.DeriveKey(tk.Token))
+		if err != nil {
+			continue
+		}
+		window := cnf.Tunnel.Window
+		if window <= 0 {
+			window = defaultTunnelWindow
+		}
+		if err = replayFilter.Check(nonce, ts, time.Duration(window)*time.Second); err != nil {
+			return "", tk, err
+		}
+		return string(target), tk, nil
+	}
+	return "", conf.TunnelToken{}, badRequestError("tunnel token mismatch")
+}
+
+// decryptLegacyTarget 旧版AES-CBC解密，不带认证，配置检查保证兼容旧版时只有一个密钥
+func decryptLegacyTarget(uri string, cnf *conf.Router) (string, conf.TunnelToken, error) {
+	x1, err := base64.StdEncoding.DecodeString(uri)
+	if err != nil {
+		return "", conf.TunnelToken{}, err
+	}
+	if len(x1) == 0 {
+		return uri, conf.TunnelToken{}, nil
+	}
+	for _, tk := range serverTokens(cnf) {
+		x2, err := crypto.DecryptAES(x1, []byte(tk.Token))
+		if err != nil {
+			continue
+		}
+		return string(x2), tk, nil
+	}
+	return "", conf.TunnelToken{}, badRequestError("tunnel token mismatch")
+}
+
+// allowTarget 检查密钥是否允许访问目标, 支持域名、*.域名和CIDR
+func allowTarget(allows []string, dstName string) bool {
+	if len(allows) == 0 {
+		return true
+	}
+	dstName = strings.ToLower(dstName)
+	ip := net.ParseIP(dstName)
+	for _, allow := range allows {
+		allow = strings.ToLower(allow)
+		if ip != nil {
+			if _, ipNet, err := net.ParseCIDR(allow); err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			if other := net.ParseIP(allow); other != nil && other.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(allow, "*.") {
+			if strings.HasSuffix(dstName, allow[1:]) {
+				return true
+			}
+			continue
+		}
+		if allow == dstName {
+			return true
+		}
+	}
+	return false
+}
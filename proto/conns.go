@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keminar/anyproxy/grace"
+)
+
+// connStat 正在转发的连接信息，transfer开始时登记
+type connStat struct {
+	user     string
+	proto    string
+	dst      string
+	rule     string
+	upstream string
+	up       int64 // 上行字节数，原子操作
+	down     int64 // 下行字节数，原子操作
+	close    func()
+}
+
+var conns sync.Map // trace ID -> *connStat
+
+// registerConn 登记连接，keep-alive复用时同一ID的后一个请求覆盖前一个
+func registerConn(s *tunnel) *connStat {
+	dst := s.req.DstName
+	if dst == "" {
+		dst = s.req.DstIP
+	}
+	st := &connStat{
+		user:     s.req.User,
+		proto:    s.req.Proto,
+		dst:      net.JoinHostPort(dst, strconv.Itoa(int(s.req.DstPort))),
+		rule:     ruleString(s.rule, s.ruleName),
+		upstream: s.via,
+		// 只关客户端时后端不返回数据转发不会结束，两边都关
+		close: func() {
+			s.conn.Close()
+			s.req.conn.Close()
+		},
+	}
+	conns.Store(s.req.ID, st)
+	return st
+}
+
+// unregisterConn 转发结束后删除，已被后一个请求覆盖的不删
+func unregisterConn(ID uint, st *connStat) {
+	conns.CompareAndDelete(ID, st)
+}
+
+// CloseConn 按trace ID关闭正在转发的连接，不存在时返回false
+func CloseConn(ID uint) bool {
+	v, ok := conns.Load(ID)
+	if !ok {
+		return false
+	}
+	v.(*connStat).close()
+	return true
+}
+
+// ruleString 命中的规则，-1为未命中显示default
+func ruleString(rule int, name string) string {
+	if rule < 0 {
+		return "default"
+	}
+	if name == "" {
+		return "#" + strconv.Itoa(rule)
+	}
+	return "#" + strconv.Itoa(rule) + " " + name
+}
+
+// ConnInfo 活动连接
+type ConnInfo struct {
+	ID        uint      `json:"id"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Proto     string    `json:"proto,omitempty"`
+	Dst       string    `json:"dst,omitempty"`      // 目标地址，还未开始转发时为空
+	Rule      string    `json:"rule,omitempty"`     // 命中的规则
+	Upstream  string    `json:"upstream,omitempty"` // 经过的代理，直连为空
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+	Start     time.Time `json:"start"`
+	Age       int64     `json:"ageSec"`
+}
+
+// Connections 所有活动连接，按ID排序
+func Connections(srv *grace.Server) []ConnInfo {
+	list := []ConnInfo{}
+	now := time.Now()
+	srv.GetConnRange(func(ID uint, startTime int64, remoteAddr string) {
+		start := time.Unix(0, startTime)
+		ci := ConnInfo{ID: ID, Client: remoteAddr, Start: start, Age: int64(now.Sub(start) / time.Second)}
+		if v, ok := conns.Load(ID); ok {
+			st := v.(*connStat)
+			ci.User, ci.Proto, ci.Dst, ci.Rule, ci.Upstream = st.user, st.proto, st.dst, st.rule, st.upstream
+			ci.BytesUp = atomic.LoadInt64(&st.up)
+			ci.BytesDown = atomic.LoadInt64(&st.down)
+		}
+		list = append(list, ci)
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
@@ -0,0 +1,135 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/utils/trace"
+)
+
+const (
+	// attemptDelay 上一个地址未返回时，间隔多久开始连下一个地址，RFC 8305 建议250毫秒
+	attemptDelay = 250 * time.Millisecond
+)
+
+// sortIPs 按优先的地址类型排序，ipv4和ipv6交替，prefer为空时ipv4优先
+func sortIPs(ips []net.IP, prefer string) []net.IP {
+	var ipv4, ipv6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	first, second := ipv4, ipv6
+	if prefer == "ipv6" {
+		first, second = ipv6, ipv4
+	}
+	list := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			list = append(list, first[i])
+		}
+		if i < len(second) {
+			list = append(list, second[i])
+		}
+	}
+	return list
+}
+
+// usableIPs 去掉熔断打开的地址，skip为false时熔断的排在最后
+func usableIPs(bc breakerConf, ips []net.IP, skip bool) []net.IP {
+	var ok, failed []net.IP
+	for _, ip := range ips {
+		if !addrReady(ip.String(), bc) {
+			failed = append(failed, ip)
+		} else {
+			ok = append(ok, ip)
+		}
+	}
+	if skip {
+		return ok
+	}
+	return append(ok, failed...)
+}
+
+// allFailed 所有地址都熔断了
+func allFailed(bc breakerConf, ips []net.IP) bool {
+	return len(ips) > 0 && len(usableIPs(bc, ips, true)) == 0
+}
+
+// dialResult 一个地址的连接结果
+type dialResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// dialIPs 按顺序错开连接多个地址，先连通的生效，RFC 8305 Happy Eyeballs
+// 连接结果记入地址的熔断器
+func dialIPs(logID uint, bc breakerConf, ips []net.IP, port uint16, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	next, pending := 0, 0
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+			results <- dialResult{conn, ip, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				addrSuccess(r.ip.String())
+				// 其它同时连通的连接关闭
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if config.DebugLevel >= config.LevelLong {
+				log.Println(trace.ID(logID), "dial", r.ip, "err", r.err)
+			}
+			// 超时时还没连上的地址都记入熔断，被取消的不是地址的问题
+			if !errors.Is(r.err, context.Canceled) {
+				addrFailure(r.ip.String(), bc)
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// 失败后马上连下一个，不等间隔，已超时不再发起
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,41 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialIPsDeadlineCountsFailure(t *testing.T) {
+	bc := breakerConf{failures: 1, cooldown: time.Minute}
+	ip := net.ParseIP("127.0.0.77")
+	defer addrBreakers.Delete(ip.String())
+	// 整体超时时还在连接的地址也要记入熔断，auto模式靠它跳过不通的地址
+	if _, err := dialIPs(0, bc, []net.IP{ip}, 9, time.Nanosecond); err == nil {
+		t.Fatal("dial succeeded before deadline")
+	}
+	if addrReady(ip.String(), bc) {
+		t.Fatal("timed out address not recorded")
+	}
+	if !allFailed(bc, []net.IP{ip}) {
+		t.Fatal("allFailed false after timeout")
+	}
+}
+
+func TestDialIPsWinnerSkipsOthers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	bc := breakerConf{failures: 1, cooldown: time.Minute}
+	conn, err := dialIPs(0, bc, []net.IP{net.ParseIP("127.0.0.1")}, port, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !addrReady("127.0.0.1", bc) {
+		t.Fatal("connected address recorded as failed")
+	}
+}
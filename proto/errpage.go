@@ -0,0 +1,166 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltpl "html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/keminar/anyproxy/utils/conf"
+	"github.com/keminar/anyproxy/utils/trace"
+)
+
+// 内置错误页模板
+const (
+	defaultErrorHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Code}} {{.Status}}</title></head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Reason}}</p>
+<hr>
+<p><small>anyproxy trace #{{.TraceID}}, host {{.Host}}, rule {{.Rule}}, {{.Time}}</small></p>
+</body>
+</html>
+`
+	defaultErrorText = `{{.Code}} {{.Status}}
+{{.Reason}}
+
+anyproxy trace #{{.TraceID}}, host {{.Host}}, rule {{.Rule}}, {{.Time}}
+`
+)
+
+var (
+	defaultHTMLTemplate = htmltpl.Must(htmltpl.New("error").Parse(defaultErrorHTML))
+	defaultTextTemplate = template.Must(template.New("error").Parse(defaultErrorText))
+)
+
+// proxyRespError 上游代理对CONNECT的非200应答
+type proxyRespError struct {
+	code   int
+	status string
+}
+
+func (e *proxyRespError) Error() string {
+	return fmt.Sprintf("Proxy response was: %s", strconv.Quote(e.status))
+}
+
+// httpErrorCode 按握手错误取应答码，规则禁止和上游代理禁止为403，超时为504，其它为502
+func httpErrorCode(err error) int {
+	var deny denyError
+	if errors.As(err, &deny) {
+		return http.StatusForbidden
+	}
+	var resp *proxyRespError
+	if errors.As(err, &resp) && (resp.code == http.StatusForbidden || resp.code == http.StatusGatewayTimeout) {
+		return resp.code
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// errorPage 错误页模板变量
+type errorPage struct {
+	Code    int
+	Status  string
+	TraceID uint
+	Rule    string // 命中的规则，未命中为 default
+	Host    string
+	Reason  string
+	Time    string
+}
+
+// executor html和text模板共用
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// cachedTemplate 已解析的模板文件，文件修改后重新解析
+type cachedTemplate struct {
+	modTime time.Time
+	tpl     executor
+}
+
+var errorTemplates sync.Map // path -> *cachedTemplate
+
+// errorTemplate 在模板目录依次查找 code.ext 和 error.ext，都没有或解析失败时用内置模板
+func errorTemplate(cnf *conf.Router, code int, isHTML bool) executor {
+	ext := ".txt"
+	if isHTML {
+		ext = ".html"
+	}
+	dir := "errors"
+	if cnf != nil && cnf.HTTP.ErrorPages != "" {
+		dir = cnf.HTTP.ErrorPages
+	}
+	dir = conf.RelPath(dir)
+	for _, name := range []string{strconv.Itoa(code) + ext, "error" + ext} {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if v, ok := errorTemplates.Load(path); ok && v.(*cachedTemplate).modTime.Equal(info.ModTime()) {
+			return v.(*cachedTemplate).tpl
+		}
+		tpl, err := parseErrorTemplate(path, isHTML)
+		if err != nil {
+			log.Println("error page", path, "err", err)
+			break
+		}
+		errorTemplates.Store(path, &cachedTemplate{modTime: info.ModTime(), tpl: tpl})
+		return tpl
+	}
+	if isHTML {
+		return defaultHTMLTemplate
+	}
+	return defaultTextTemplate
+}
+
+// parseErrorTemplate html模板会转义变量
+func parseErrorTemplate(path string, isHTML bool) (executor, error) {
+	if isHTML {
+		return htmltpl.ParseFiles(path)
+	}
+	return template.ParseFiles(path)
+}
+
+// writeHTTPError 握手失败时给客户端返回错误页，rule为命中规则序号，-1为未命中
+func writeHTTPError(w io.Writer, req *Request, host string, rule int, ruleName string, isHTML bool, err error) {
+	code := httpErrorCode(err)
+	page := errorPage{
+		Code:    code,
+		Status:  http.StatusText(code),
+		TraceID: req.ID,
+		Rule:    ruleString(rule, ruleName),
+		Host:    host,
+		Reason:  err.Error(),
+		Time:    time.Now().Format(time.RFC3339),
+	}
+	var body bytes.Buffer
+	if e := errorTemplate(req.cnf, code, isHTML).Execute(&body, page); e != nil {
+		log.Println(trace.ID(req.ID), "error page err", e.Error())
+		body.Reset()
+		fmt.Fprintf(&body, "%d %s\n", code, page.Status)
+	}
+	contentType := "text/plain; charset=utf-8"
+	if isHTML {
+		contentType = "text/html; charset=utf-8"
+	}
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nAnyproxy-Trace-Id: %d\r\nConnection: close\r\n\r\n",
+		code, page.Status, contentType, body.Len(), req.ID)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,164 @@
+package proto
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/keminar/anyproxy/utils/cache"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// RouteExplain 路由说明，和handshake用同一套决策，只做DNS解析和代理可用检查，不转发数据
+type RouteExplain struct {
+	Host       string   `json:"host"`
+	Port       uint16   `json:"port"`
+	Proto      string   `json:"proto"`
+	From       string   `json:"from,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Rule       int      `json:"rule"`               // 命中规则序号，从0开始，-1为未命中用默认配置
+	RuleName   string   `json:"ruleName,omitempty"` // 命中规则的name
+	Match      string   `json:"match,omitempty"`    // 命中规则的比对方案
+	Ruleset    string   `json:"ruleset,omitempty"`
+	Target     string   `json:"target"`               // 生效的访问策略
+	DNS        string   `json:"dns"`                  // 生效的DNS策略
+	IP         string   `json:"ip,omitempty"`         // 规则指定或DNS解析的ip
+	IPs        []string `json:"ips,omitempty"`        // 直连时依次尝试的所有ip，熔断的排在最后
+	DstPort    uint16   `json:"dstPort"`              // 换端口后的目标端口
+	Upstream   string   `json:"upstream,omitempty"`   // 选用的代理服务器
+	Via        string   `json:"via"`                  // direct 直连, proxy 代理, auto 先直连失败再代理, deny 拒绝
+	Connect    string   `json:"connect,omitempty"`    // 连接的地址
+	TargetAddr string   `json:"targetAddr,omitempty"` // 经代理访问的目标地址
+	Error      string   `json:"error,omitempty"`
+}
+
+// ExplainRoute 说明目标地址会怎么走, addr为 host[:port], from为客户端ip
+func ExplainRoute(addr, proto, from, user string) (*RouteExplain, error) {
+	cnf := conf.Current()
+	if cnf == nil {
+		return nil, fmt.Errorf("router config is not loaded")
+	}
+	switch proto {
+	case "":
+		proto = protoHTTP
+	case protoHTTP, protoHTTPS, protoTCP, protoUDP:
+	default:
+		return nil, fmt.Errorf("proto %s is not supported", proto)
+	}
+	name, port, err := splitExplainAddr(addr, proto)
+	if err != nil {
+		return nil, err
+	}
+	e := &RouteExplain{Host: name, Port: port, Proto: proto, From: from, User: user}
+
+	s := &tunnel{req: &Request{User: user, cnf: cnf}, inboundIP: from}
+	// http请求和handshake一样只传域名，tcp请求目标为ip时传ip
+	dstName, dstIP := name, ""
+	if ip := net.ParseIP(name); ip != nil && (proto == protoTCP || proto == protoUDP) {
+		dstName, dstIP = "", ip.String()
+	}
+	r, err := s.route(proto, dstName, dstIP, port)
+	e.Rule = r.rule
+	if r.rule >= 0 {
+		e.RuleName = r.host.Name
+		e.Match = getString(r.host.Match, cnf.Default.Match, "equal")
+		e.Ruleset = r.host.Ruleset
+	}
+	e.Target, e.DNS, e.IP, e.DstPort = r.target, r.dns, r.dstIP, r.dstPort
+	if len(r.dstIPs) > 1 {
+		for _, ip := range usableIPs(getBreakerConf(cnf), r.dstIPs, false) {
+			e.IPs = append(e.IPs, ip.String())
+		}
+	}
+	if err != nil {
+		e.Via = "deny"
+		e.Error = err.Error()
+		return e, nil
+	}
+
+	confDNS := r.dns
+	if r.up.server != "" && r.up.port > 0 && r.target != "local" {
+		e.Upstream = r.up.scheme + "://" + r.up.addr()
+		e.Via = "proxy"
+		if r.target == "auto" {
+			if r.state != cache.StateFail {
+				e.Via = "auto"
+				_, e.Connect = s.buildAddress(dstName, r.dstIP, r.dstPort, false)
+			}
+			confDNS = "remote"
+		}
+		_, e.TargetAddr = s.proxyTarget(dstName, r.dstIP, r.dstPort, confDNS)
+		if e.Via == "proxy" {
+			e.Connect = r.up.addr()
+		}
+	} else {
+		e.Via = "direct"
+		_, e.Connect = s.buildAddress(dstName, r.dstIP, r.dstPort, false)
+	}
+	return e, nil
+}
+
+// splitExplainAddr 解析 host[:port]，不带端口时按协议取默认端口
+func splitExplainAddr(addr, proto string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// 不带端口
+		host = strings.Trim(addr, "[]")
+		switch proto {
+		case protoHTTPS:
+			return host, 443, nil
+		case protoHTTP:
+			return host, 80, nil
+		}
+		return "", 0, fmt.Errorf("port is required for %s", proto)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+// String 命令行输出
+func (e *RouteExplain) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "request:  %s %s\n", e.Proto, net.JoinHostPort(e.Host, strconv.Itoa(int(e.Port))))
+	if e.From != "" || e.User != "" {
+		fmt.Fprintf(&b, "from:     %s %s\n", e.From, e.User)
+	}
+	if e.Rule >= 0 {
+		fmt.Fprintf(&b, "rule:     #%d name=%s match=%s", e.Rule, e.RuleName, e.Match)
+		if e.Ruleset != "" {
+			fmt.Fprintf(&b, " ruleset=%s", e.Ruleset)
+		}
+		b.WriteString("\n")
+	} else {
+		b.WriteString("rule:     none, use default\n")
+	}
+	fmt.Fprintf(&b, "target:   %s\n", e.Target)
+	fmt.Fprintf(&b, "dns:      %s\n", e.DNS)
+	if e.IP != "" {
+		fmt.Fprintf(&b, "ip:       %s\n", e.IP)
+	}
+	if len(e.IPs) > 1 {
+		fmt.Fprintf(&b, "ips:      %s\n", strings.Join(e.IPs, ", "))
+	}
+	if e.DstPort != e.Port {
+		fmt.Fprintf(&b, "port:     %d -> %d\n", e.Port, e.DstPort)
+	}
+	if e.Upstream != "" {
+		fmt.Fprintf(&b, "upstream: %s\n", e.Upstream)
+	}
+	switch e.Via {
+	case "deny":
+		fmt.Fprintf(&b, "result:   deny, %s\n", e.Error)
+	case "auto":
+		fmt.Fprintf(&b, "result:   try direct %s, then proxy %s for %s\n", e.Connect, e.Upstream, e.TargetAddr)
+	case "proxy":
+		fmt.Fprintf(&b, "result:   proxy %s for %s\n", e.Connect, e.TargetAddr)
+	default:
+		fmt.Fprintf(&b, "result:   direct %s\n", e.Connect)
+	}
+	return b.String()
+}
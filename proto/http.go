@@ -3,6 +3,7 @@ package proto
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -10,7 +11,6 @@ import (
 	"strings"
 
 	"github.com/keminar/anyproxy/config"
-	"github.com/keminar/anyproxy/crypto"
 	"github.com/keminar/anyproxy/nat"
 	"github.com/keminar/anyproxy/proto/http"
 	"github.com/keminar/anyproxy/proto/text"
@@ -37,6 +37,9 @@ type httpStream struct {
 	BodyBuf      []byte
 	clientUnRead int
 	tp           *text.Reader
+	from         string           //client 或 server
+	direct       bool             //首行不带域名，直接请求本服务或透明代理
+	token        conf.TunnelToken //服务端解密成功的密钥
 }
 
 func newHTTPStream(req *Request) *httpStream {
@@ -98,25 +101,20 @@ func (that *httpStream) readFistLine() bool {
 }
 
 func (that *httpStream) readRequest(from string) (canProxy bool, err error) {
+	that.from = from
 	rawurl := that.RequestURI
 	if that.Method == "CONNECT" && from == "server" {
-		key := []byte(getToken())
-		x1, err := base64.StdEncoding.DecodeString(that.RequestURI)
-		if err != nil {
+		if rawurl, that.token, err = decryptTarget(that.RequestURI, that.req.cnf); err != nil {
 			return false, err
 		}
-		if len(x1) > 0 {
-			x2, err := crypto.DecryptAES(x1, key)
-			if err != nil {
-				return false, err
-			}
-			rawurl = string(x2)
-		}
+		// 命名密钥作为登录用户，可用于hosts规则和统计
+		that.req.User = that.token.Name
 	}
 	if config.DebugLevel >= config.LevelDebug {
 		log.Println(trace.ID(that.req.ID), "rawurl:", rawurl)
 	}
-	justAuthority := that.Method == "CONNECT" && !strings.HasPrefix(rawurl, "/")
+	that.direct = strings.HasPrefix(rawurl, "/")
+	justAuthority := that.Method == "CONNECT" && !that.direct
 	addedScheme := false
 	if justAuthority {
 		//CONNECT是http的,如果RequestURI不是/开头,则为域名且不带http://, 这里补上
@@ -169,7 +167,7 @@ func (that *httpStream) readRequest(from string) (canProxy bool, err error) {
 	} else {
 		// 在代理部分vue本地开发环境时，有些用到websocket技术的请求首行带域名反而会404
 		// 这种情况可以把域名配置在自定义配置里去掉首行域名
-		if strings.ToLower(that.URL.Scheme) == "http" && firstLineHost(that.URL.Host) == "off" {
+		if strings.ToLower(that.URL.Scheme) == "http" && firstLineHost(that.req.cnf, that.URL.Host) == "off" {
 			if config.DebugLevel >= config.LevelDebug {
 				log.Println(trace.ID(that.req.ID), "firstline host removed")
 			}
@@ -194,12 +192,12 @@ func (that *httpStream) readRequest(from string) (canProxy bool, err error) {
 	return true, nil
 }
 
-func firstLineHost(host string) string {
+func firstLineHost(cnf *conf.Router, host string) string {
 	host = strings.ReplaceAll(host, ":", ".")
-	if val, ok := conf.RouterConfig.FirstLine.Custom[host]; ok {
+	if val, ok := cnf.FirstLine.Custom[host]; ok {
 		return val
 	}
-	if conf.RouterConfig.FirstLine.Host == "off" {
+	if cnf.FirstLine.Host == "off" {
 		return "off"
 	}
 	return "on"
@@ -285,7 +283,54 @@ func (that *httpStream) badRequest(err error) {
 	fmt.Fprintf(that.req.conn, "HTTP/1.1 "+publicErr+errorHeaders+publicErr)
 }
 
+// authorize 校验Proxy-Authorization，通过后去掉头部不再转发给后端
+func (that *httpStream) authorize() bool {
+	users := that.req.cnf.HTTP.Users
+	if that.from != "client" || len(users) == 0 {
+		return true
+	}
+	auth := that.Header.Get("Proxy-Authorization")
+	that.Header.Del("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	c, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return false
+	}
+	name, pass, ok := strings.Cut(string(c), ":")
+	if !ok || !checkUser(users, name, pass) {
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("http user %s auth fail", strconv.Quote(name)))
+		return false
+	}
+	that.req.User = name
+	return true
+}
+
+// proxyAuthRequired 407响应
+func (that *httpStream) proxyAuthRequired() {
+	realm := config.IfEmptyThen(that.req.cnf.HTTP.Realm, "anyproxy", "")
+	publicErr := "407 Proxy Authentication Required"
+	fmt.Fprintf(that.req.conn, "HTTP/1.1 %s\r\nProxy-Authenticate: Basic realm=%s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		publicErr, strconv.Quote(realm), len(publicErr), publicErr)
+}
+
+// errorResponse 握手失败时返回403/502/504错误页，浏览器不接受html或CONNECT请求时返回文本
+func (that *httpStream) errorResponse(tunnel *tunnel, err error) {
+	isHTML := that.Method != "CONNECT" && strings.Contains(that.Header.Get("Accept"), "text/html")
+	writeHTTPError(that.req.conn, that.req, that.req.DstName, tunnel.rule, tunnel.ruleName, isHTML, err)
+}
+
 func (that *httpStream) response() error {
+	// 系统获取PAC时不带代理认证
+	if that.servePAC() {
+		return nil
+	}
+	if !that.authorize() {
+		that.proxyAuthRequired()
+		return errors.New("proxy authentication required")
+	}
 	specialHeader := "Anyproxy-Action"
 	if config.DebugLevel >= config.LevelDebug {
 		log.Println(trace.ID(that.req.ID), "nat server status:", nat.Eable(), ",special header:", that.Header.Get(specialHeader))
@@ -316,6 +361,7 @@ func (that *httpStream) response() error {
 		err := tunnel.handshake(protoHTTPS, that.req.DstName, "", that.req.DstPort)
 		if err != nil {
 			log.Println(trace.ID(that.req.ID), "handshake err", err.Error())
+			that.errorResponse(tunnel, err)
 			return err
 		}
 		// 遇到过后端连不上先输出established导致某手机app闪退
@@ -331,9 +377,14 @@ func (that *httpStream) response() error {
 		err := tunnel.handshake(protoHTTP, that.req.DstName, "", that.req.DstPort)
 		if err != nil {
 			log.Println(trace.ID(that.req.ID), "handshake err", err.Error())
+			that.errorResponse(tunnel, err)
 			return err
 		}
 
+		// 上游http代理需要认证
+		if tunnel.proxyAuth != "" {
+			that.Header.Set("Proxy-Authorization", tunnel.proxyAuth)
+		}
 		// 先将请求头部发出
 		tunnel.Write([]byte(fmt.Sprintf("%s\r\n", that.FirstLine)))
 		that.Header.Write(tunnel)
@@ -347,10 +398,14 @@ func (that *httpStream) response() error {
 }
 
 func (that *httpStream) showIP(method string) {
+	from := that.req.conn.RemoteAddr().String()
+	if that.req.User != "" {
+		from = that.req.User + "@" + from
+	}
 	if method == "CONNECT" {
-		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", method, that.req.conn.RemoteAddr().String(), that.req.DstName, that.req.DstPort))
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", method, from, that.req.DstName, that.req.DstPort))
 	} else {
-		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s", method, that.req.conn.RemoteAddr().String(), that.Request()))
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s", method, from, that.Request()))
 	}
 }
 
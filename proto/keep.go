@@ -11,7 +11,7 @@ import (
 )
 
 // KeepHandler HTTP/1.1复用处理
-func KeepHandler(ctx context.Context, tcpConn *net.TCPConn, buf []byte) error {
+func KeepHandler(ctx context.Context, tcpConn net.Conn, buf []byte) error {
 	req := NewRequestWithBuf(ctx, tcpConn, buf)
 
 	// test if the underlying fd is nil
@@ -39,7 +39,7 @@ func KeepHandler(ctx context.Context, tcpConn *net.TCPConn, buf []byte) error {
 }
 
 // 预判后面的包是不是http链接
-func isKeepAliveHttp(ctx context.Context, tcpConn *net.TCPConn, buf []byte) bool {
+func isKeepAliveHttp(ctx context.Context, tcpConn net.Conn, buf []byte) bool {
 	req := NewRequestWithBuf(ctx, tcpConn, buf)
 	req.ReadRequest("client")
 	return req.Proto == "http"
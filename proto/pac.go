@@ -0,0 +1,246 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/utils/conf"
+	"github.com/keminar/anyproxy/utils/trace"
+)
+
+const (
+	// PACContentType PAC文件类型
+	PACContentType = "application/x-ns-proxy-autoconfig"
+	// pacBlackhole 禁止访问的域名走一个连不上的地址
+	pacBlackhole = "PROXY 127.0.0.1:9"
+	// pacCacheSize 按代理地址缓存的PAC文件数
+	pacCacheSize = 64
+)
+
+// PAC中按顺序比对规则，和 hostIndex.lookup 一样先配置的优先
+const pacScript = `// anyproxy PAC, generated from hosts and default
+var rules = %s;
+var fallback = %s;
+
+function inNets(host, nets) {
+  for (var i = 0; i < nets.length; i++) {
+    if (isInNet(host, nets[i][0], nets[i][1])) return true;
+  }
+  return false;
+}
+
+function has(set, key) {
+  return set !== undefined && Object.prototype.hasOwnProperty.call(set, key);
+}
+
+function match(rule, host, ipv4) {
+  switch (rule.m) {
+  case "equal":
+    return host == rule.v;
+  case "suffix":
+    return host == rule.v || dnsDomainIs(host, "." + rule.v);
+  case "contain":
+    return host.indexOf(rule.v) >= 0;
+  case "glob":
+    return shExpMatch(host, rule.v);
+  case "preg":
+    if (rule.re === undefined) {
+      try { rule.re = new RegExp(rule.v); } catch (e) { rule.re = null; }
+    }
+    return rule.re !== null && rule.re.test(host);
+  case "cidr":
+    return ipv4 && inNets(host, rule.n);
+  case "ruleset":
+    if (ipv4 && rule.n && inNets(host, rule.n)) return true;
+    var labels = host.split(".");
+    for (var i = 0; i < labels.length; i++) {
+      var d = labels.slice(i).join(".");
+      if (has(rule.s, d) || (i == 0 && has(rule.e, d)) || (i > 0 && has(rule.b, d))) return true;
+    }
+    if (rule.k) {
+      for (var j = 0; j < rule.k.length; j++) {
+        if (host.indexOf(rule.k[j]) >= 0) return true;
+      }
+    }
+    return false;
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (host.charAt(host.length - 1) == ".") host = host.substring(0, host.length - 1);
+  var ipv4 = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+  for (var i = 0; i < rules.length; i++) {
+    if (match(rules[i], host, ipv4)) return rules[i].r;
+  }
+  return fallback;
+}
+`
+
+// pacRule PAC中的一条规则，字段名缩短减小文件
+type pacRule struct {
+	Match   string          `json:"m"`
+	Value   string          `json:"v,omitempty"`
+	Nets    [][2]string     `json:"n,omitempty"` // ipv4网段 [ip, 掩码]
+	Exact   map[string]bool `json:"e,omitempty"` // 规则集只匹配自身的域名
+	Suffix  map[string]bool `json:"s,omitempty"` // 规则集匹配自身及子域名的域名
+	Sub     map[string]bool `json:"b,omitempty"` // 规则集只匹配子域名的域名
+	Keyword []string        `json:"k,omitempty"`
+	Result  string          `json:"r"`
+}
+
+// PACFile 生成的PAC文件
+type PACFile struct {
+	Body []byte
+	ETag string
+}
+
+var (
+	pacMu      sync.Mutex
+	pacCnf     *conf.Router
+	pacVersion int64
+	pacFiles   = make(map[string]*PACFile)
+)
+
+// PAC 取PAC文件，proxy为PAC中的代理地址，配置重新加载或规则集变化后重新生成
+func PAC(cnf *conf.Router, proxy string) *PACFile {
+	version := conf.RuleSetVersion()
+	pacMu.Lock()
+	defer pacMu.Unlock()
+	if pacCnf != cnf || pacVersion != version || len(pacFiles) >= pacCacheSize {
+		pacCnf, pacVersion = cnf, version
+		pacFiles = make(map[string]*PACFile)
+	}
+	if f, ok := pacFiles[proxy]; ok {
+		return f
+	}
+	body := genPAC(cnf, "PROXY "+proxy)
+	sum := sha1.Sum(body)
+	f := &PACFile{Body: body, ETag: strconv.Quote(hex.EncodeToString(sum[:]))}
+	pacFiles[proxy] = f
+	return f
+}
+
+// PACProxyAddr PAC中的代理地址，配置的优先，否则用请求PAC的域名加代理端口
+func PACProxyAddr(cnf *conf.Router, reqHost string) string {
+	if cnf.PAC.Proxy != "" {
+		return cnf.PAC.Proxy
+	}
+	host := reqHost
+	if h, _, err := net.SplitHostPort(reqHost); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(config.ListenPort())))
+}
+
+// genPAC 按hosts顺序生成规则，只对部分用户、端口或来源生效的规则PAC中无法判断，跳过
+func genPAC(cnf *conf.Router, proxy string) []byte {
+	rules := []pacRule{}
+	for _, h := range cnf.Hosts {
+		if len(h.User) > 0 || h.HasCond() {
+			continue
+		}
+		rule := pacRule{Match: getString(h.Match, cnf.Default.Match, "equal"), Result: pacResult(cnf, h, proxy)}
+		if h.Ruleset != "" {
+			rule.Match = "ruleset"
+			rs := conf.GetRuleSet(h.Ruleset)
+			if rs == nil {
+				continue
+			}
+			rule.Exact, rule.Suffix, rule.Sub = pacSet(rs.Exact), pacSet(rs.Suffix), pacSet(rs.Sub)
+			rule.Keyword = rs.Keyword
+			rule.Nets = pacNets(rs.CIDR...)
+		} else if rule.Match == "cidr" {
+			if rule.Nets = pacNets(h.CIDR()); len(rule.Nets) == 0 {
+				continue
+			}
+		} else if h.Name == "" {
+			continue
+		} else if rule.Match == "preg" {
+			rule.Value = h.Name
+		} else {
+			rule.Value = strings.ToLower(strings.TrimPrefix(h.Name, "."))
+		}
+		rules = append(rules, rule)
+	}
+	data, _ := json.Marshal(rules)
+	fallback, _ := json.Marshal(pacResult(cnf, conf.Host{}, proxy))
+	var b bytes.Buffer
+	fmt.Fprintf(&b, pacScript, data, fallback)
+	return b.Bytes()
+}
+
+// pacResult 规则对应的PAC返回值，local直连，deny走不通的地址，其它经本代理
+// 配置了自定义代理时handshake会改为remote，也经本代理
+func pacResult(cnf *conf.Router, h conf.Host, proxy string) string {
+	target := getString(h.Target, cnf.Default.Target, "auto")
+	switch {
+	case target == "deny":
+		return pacBlackhole
+	case target == "local" && h.Proxy == "" && h.Upstream == "":
+		return "DIRECT"
+	}
+	return proxy
+}
+
+// pacSet 域名列表转为集合
+func pacSet(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(list))
+	for _, name := range list {
+		set[strings.ToLower(name)] = true
+	}
+	return set
+}
+
+// pacNets ipv4网段转为isInNet的参数，PAC中不支持ipv6网段
+func pacNets(nets ...*net.IPNet) [][2]string {
+	var list [][2]string
+	for _, n := range nets {
+		if n == nil || n.IP.To4() == nil || len(n.Mask) != net.IPv4len {
+			continue
+		}
+		list = append(list, [2]string{n.IP.To4().String(), net.IP(n.Mask).String()})
+	}
+	return list
+}
+
+// servePAC 直接请求代理端口的 /proxy.pac 或 /wpad.dat 时返回PAC文件，需要配置pac.enable
+func (that *httpStream) servePAC() bool {
+	if !that.req.cnf.PAC.Enable || that.from != "client" || !that.direct || that.Method != "GET" {
+		return false
+	}
+	if that.URL.Path != "/proxy.pac" && that.URL.Path != "/wpad.dat" {
+		return false
+	}
+	// 透明代理转来的请求目标端口不是本服务
+	if that.req.DstPort != config.ListenPort() {
+		return false
+	}
+	f := PAC(that.req.cnf, PACProxyAddr(that.req.cnf, that.Host))
+	log.Println(trace.ID(that.req.ID), "PAC", that.req.conn.RemoteAddr().String(), that.URL.Path)
+	if that.Header.Get("If-None-Match") == f.ETag {
+		fmt.Fprintf(that.req.conn, "HTTP/1.1 304 Not Modified\r\nETag: %s\r\nConnection: close\r\n\r\n", f.ETag)
+		return true
+	}
+	fmt.Fprintf(that.req.conn, "HTTP/1.1 200 OK\r\nContent-Type: %s\r\nContent-Length: %d\r\nETag: %s\r\nCache-Control: no-cache\r\nConnection: close\r\n\r\n",
+		PACContentType, len(f.Body), f.ETag)
+	that.req.conn.Write(f.Body)
+	return true
+}
@@ -10,16 +10,18 @@ import (
 	"github.com/keminar/anyproxy/proto/tcp"
 )
 
-// AesToken 加密密钥, 必须16位长度
+// AesToken 默认加密密钥, 兼容旧版协议时必须16位长度
 var AesToken = "anyproxyproxyany"
 
 // Request 请求类
 type Request struct {
 	ID     uint
 	ctx    context.Context
-	conn   *net.TCPConn
+	cnf    *conf.Router // 接收连接时的配置快照，请求处理中配置重新加载不受影响
+	conn   net.Conn     // 客户端连接，tunnel开启TLS时为*tls.Conn
 	reader *tcp.Reader
 	Proto  string //http
+	User   string //认证通过的用户名
 
 	Stream  stream
 	DstName string //目标域名
@@ -28,12 +30,18 @@ type Request struct {
 }
 
 // NewRequest 请求类
-func NewRequest(ctx context.Context, conn *net.TCPConn) *Request {
+func NewRequest(ctx context.Context, conn net.Conn) *Request {
+	return newRequest(ctx, conn, conf.Current())
+}
+
+// newRequest 用指定的配置快照
+func newRequest(ctx context.Context, conn net.Conn, cnf *conf.Router) *Request {
 	// 取traceID
 	traceID, _ := ctx.Value(grace.TraceIDContextKey).(uint)
 	c := &Request{
 		ctx:    ctx,
 		ID:     traceID,
+		cnf:    cnf,
 		conn:   conn,
 		reader: tcp.NewReader(conn),
 	}
@@ -41,12 +49,13 @@ func NewRequest(ctx context.Context, conn *net.TCPConn) *Request {
 }
 
 // NewRequestWithBuf 请求类，前带buf内容
-func NewRequestWithBuf(ctx context.Context, conn *net.TCPConn, buf []byte) *Request {
+func NewRequestWithBuf(ctx context.Context, conn net.Conn, buf []byte) *Request {
 	// 取traceID
 	traceID, _ := ctx.Value(grace.TraceIDContextKey).(uint)
 	c := &Request{
 		ctx:    ctx,
 		ID:     traceID,
+		cnf:    conf.Current(),
 		conn:   conn,
 		reader: tcp.NewReaderWithBuf(conn, buf),
 	}
@@ -56,8 +65,8 @@ func NewRequestWithBuf(ctx context.Context, conn *net.TCPConn, buf []byte) *Requ
 // ReadRequest 分析请求内容
 func (that *Request) ReadRequest(from string) (canProxy bool, err error) {
 	//如果启用了tcpcopy 且目标地址也有配置，则进行tcpcopy转发
-	if conf.RouterConfig.TcpCopy.Enable {
-		if conf.RouterConfig.TcpCopy.IP != "" && conf.RouterConfig.TcpCopy.Port > 0 {
+	if that.cnf.TcpCopy.Enable {
+		if that.cnf.TcpCopy.IP != "" && that.cnf.TcpCopy.Port > 0 {
 			s := newTCPCopy(that)
 			that.Proto = "tcp"
 			that.Stream = s
@@ -70,7 +79,7 @@ func (that *Request) ReadRequest(from string) (canProxy bool, err error) {
 	}
 
 	var s stream
-	protos := []string{"http", "socks5"}
+	protos := []string{"http", "socks5", "socks4"}
 	for _, v := range protos {
 		switch v {
 		case "http":
@@ -85,6 +94,12 @@ func (that *Request) ReadRequest(from string) (canProxy bool, err error) {
 				that.Proto = v
 				break
 			}
+		case "socks4":
+			s = newSocks4Stream(that)
+			if s.validHead() {
+				that.Proto = v
+				break
+			}
 		}
 		if that.Proto != "" {
 			break
@@ -99,9 +114,9 @@ func (that *Request) ReadRequest(from string) (canProxy bool, err error) {
 }
 
 // 加密Token
-func getToken() string {
-	if conf.RouterConfig.Token == "" {
+func getToken(cnf *conf.Router) string {
+	if cnf.Token == "" {
 		return AesToken
 	}
-	return conf.RouterConfig.Token
+	return cnf.Token
 }
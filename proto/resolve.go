@@ -0,0 +1,149 @@
+package proto
+
+import (
+	"context"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keminar/anyproxy/dns"
+	"github.com/keminar/anyproxy/utils/cache"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// resolverSet 按配置生成的DNS服务器，生成后只读
+type resolverSet struct {
+	cnf     *conf.Router
+	servers map[string]*dns.Client
+	local   []*dns.Client // dns为local时使用，为空用系统解析
+}
+
+var (
+	resolverCache atomic.Value // *resolverSet
+	resolverMu    sync.Mutex
+)
+
+// currentResolvers 取配置快照的DNS服务器，配置重新加载后重建
+func currentResolvers(cnf *conf.Router) *resolverSet {
+	if rs, ok := resolverCache.Load().(*resolverSet); ok && rs.cnf == cnf {
+		return rs
+	}
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	if rs, ok := resolverCache.Load().(*resolverSet); ok && rs.cnf == cnf {
+		return rs
+	}
+	rs := newResolverSet(cnf)
+	if cnf == conf.Current() {
+		resolverCache.Store(rs)
+	}
+	return rs
+}
+
+// newResolverSet 地址在加载配置时已校验
+func newResolverSet(cnf *conf.Router) *resolverSet {
+	rs := &resolverSet{cnf: cnf, servers: make(map[string]*dns.Client)}
+	timeout := time.Duration(cnf.DNS.Timeout) * time.Second
+	for _, s := range cnf.DNS.Servers {
+		if c, err := dns.NewClient(s.Name, s.Addr, timeout); err == nil {
+			rs.servers[s.Name] = c
+		}
+	}
+	for _, name := range cnf.DNS.Local {
+		if c, ok := rs.servers[name]; ok {
+			rs.local = append(rs.local, c)
+		}
+	}
+	return rs
+}
+
+// clients 按DNS策略选择服务器，local未配置服务器时返回nil用系统解析
+func (rs *resolverSet) clients(confDNS string) []*dns.Client {
+	if confDNS == "" || confDNS == "local" || confDNS == "remote" {
+		return rs.local
+	}
+	var list []*dns.Client
+	for _, name := range strings.Split(confDNS, ",") {
+		if c, ok := rs.servers[strings.TrimSpace(name)]; ok {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+
+// lookupIP 按DNS策略解析域名并缓存，同一策略同一域名同时只解析一次
+func (rs *resolverSet) lookupIP(ctx context.Context, logID uint, confDNS, host string) ([]net.IP, error) {
+	clients := rs.clients(confDNS)
+	// 不同服务器的结果可能不同，缓存按服务器区分
+	key := host
+	if confDNS != "" && confDNS != "local" && confDNS != "remote" {
+		key = host + "@" + confDNS
+	}
+	return cache.ResolveLookup.Resolve(logID, key, func() ([]net.IP, time.Duration, error) {
+		if len(clients) > 0 {
+			return dns.LookupIP(ctx, clients, host)
+		}
+		// 系统解析没有ttl，用缓存的默认时间
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			err = dns.ErrNotFound
+		}
+		return ips, 0, err
+	})
+}
+
+// dnsCacheOptions 按配置生成缓存设置
+func dnsCacheOptions(cnf *conf.Router) cache.Options {
+	c := cnf.DNS.Cache
+	return cache.Options{
+		Size:        c.Size,
+		MinTTL:      time.Duration(c.MinTTL) * time.Second,
+		MaxTTL:      time.Duration(c.MaxTTL) * time.Second,
+		NegativeTTL: time.Duration(c.NegativeTTL) * time.Second,
+	}
+}
+
+// dnsSnapshotPath 缓存保存位置
+func dnsSnapshotPath() string {
+	return filepath.Join(conf.CacheDir(), "dns_cache.json")
+}
+
+// dnsSnapshotInterval 定时保存间隔
+const dnsSnapshotInterval = 5 * time.Minute
+
+// StartDNSCache 应用缓存设置，开启snapshot时加载上次保存的缓存并定时保存
+func StartDNSCache() {
+	cnf := conf.Current()
+	cache.ResolveLookup.SetOptions(dnsCacheOptions(cnf))
+	conf.OnReload("dnscache", func(old, cnf *conf.Router) {
+		if old.DNS.Cache != cnf.DNS.Cache {
+			cache.ResolveLookup.SetOptions(dnsCacheOptions(cnf))
+		}
+	})
+	if cnf.DNS.Cache.Snapshot {
+		if n, err := cache.ResolveLookup.Load(dnsSnapshotPath()); err != nil {
+			log.Println("dns cache load err", err)
+		} else if n > 0 {
+			log.Println("dns cache loaded", n, "entries")
+		}
+	}
+	go func() {
+		for range time.Tick(dnsSnapshotInterval) {
+			SaveDNSCache()
+		}
+	}()
+}
+
+// SaveDNSCache 开启snapshot时保存缓存，退出前调用
+func SaveDNSCache() {
+	if !conf.Current().DNS.Cache.Snapshot {
+		return
+	}
+	if err := cache.ResolveLookup.Save(dnsSnapshotPath()); err != nil {
+		log.Println("dns cache save err", err)
+	}
+}
@@ -0,0 +1,342 @@
+package proto
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// hostIndex hosts规则索引，按配置生成后只读，保持原配置顺序先匹配先生效
+type hostIndex struct {
+	cnf     *conf.Router
+	version int64 // 规则集版本，规则集更新后重建
+	hosts   []conf.Host
+	match   []string         // 每条规则实际的比对方案
+	exact   map[string][]int // equal 完全相等
+	domain  *domainNode      // suffix 和 *.域名 形式的glob
+	ipv4    *cidrNode        // ip 和 cidr 规则
+	ipv6    *cidrNode
+	linear  []int // contain、preg、其它glob 和只有端口来源条件的规则逐条匹配
+
+	keywords map[int][]string // 规则集中的关键字
+}
+
+// maxRuleIndexes 保留索引的配置快照数，重新加载前接收的请求和UDP转发还在用旧快照
+const maxRuleIndexes = 4
+
+var (
+	ruleMu      sync.RWMutex
+	ruleIndexes = make(map[*conf.Router]*hostIndex)
+	ruleOrder   []*conf.Router // 按生成顺序，超过数量时淘汰最早的
+)
+
+// currentIndex 取配置快照的索引，每个快照只生成一次，规则集更新后重建
+func currentIndex(cnf *conf.Router) *hostIndex {
+	version := conf.RuleSetVersion()
+	ruleMu.RLock()
+	idx := ruleIndexes[cnf]
+	ruleMu.RUnlock()
+	if idx != nil && idx.version == version {
+		return idx
+	}
+	ruleMu.Lock()
+	defer ruleMu.Unlock()
+	if idx = ruleIndexes[cnf]; idx != nil && idx.version == version {
+		return idx
+	}
+	if idx == nil {
+		ruleOrder = append(ruleOrder, cnf)
+		if len(ruleOrder) > maxRuleIndexes {
+			delete(ruleIndexes, ruleOrder[0])
+			ruleOrder = ruleOrder[1:]
+		}
+	}
+	idx = newHostIndex(cnf)
+	idx.version = version
+	ruleIndexes[cnf] = idx
+	return idx
+}
+
+// newHostIndex 生成索引
+func newHostIndex(cnf *conf.Router) *hostIndex {
+	idx := &hostIndex{
+		cnf:    cnf,
+		hosts:  cnf.Hosts,
+		match:  make([]string, len(cnf.Hosts)),
+		exact:  make(map[string][]int),
+		domain: newDomainNode(),
+		ipv4:   &cidrNode{},
+		ipv6:   &cidrNode{},
+
+		keywords: make(map[int][]string),
+	}
+	for i, h := range cnf.Hosts {
+		match := getString(h.Match, cnf.Default.Match, "equal")
+		if h.Ruleset != "" {
+			match = "ruleset"
+		} else if h.Name == "" && h.HasCond() {
+			// 没有域名只按端口和来源匹配
+			match = "any"
+		}
+		idx.match[i] = match
+		switch match {
+		case "ruleset":
+			idx.insertRuleSet(conf.GetRuleSet(h.Ruleset), i)
+		case "equal":
+			if ip := net.ParseIP(h.Name); ip != nil {
+				idx.insertIP(ip, i)
+			} else {
+				idx.exact[h.Name] = append(idx.exact[h.Name], i)
+			}
+		case "cidr":
+			if n := h.CIDR(); n != nil {
+				idx.insertCIDR(n, i)
+			}
+		case "suffix":
+			suffix := strings.ToLower(strings.TrimPrefix(h.Name, "."))
+			if suffix != "" {
+				idx.domain.insert(suffix, i, matchSuffix)
+			}
+		case "glob":
+			// *.example.com 只匹配子域名，可以放到域名树
+			if sub := strings.TrimPrefix(h.Name, "*."); sub != h.Name && sub != "" && !strings.ContainsAny(sub, "*?") {
+				idx.domain.insert(strings.ToLower(sub), i, matchSub)
+			} else {
+				idx.linear = append(idx.linear, i)
+			}
+		default:
+			idx.linear = append(idx.linear, i)
+		}
+	}
+	return idx
+}
+
+// insertRuleSet 规则集内容按类型插入各索引，未加载时不匹配
+func (idx *hostIndex) insertRuleSet(rs *conf.RuleSet, i int) {
+	if rs == nil {
+		return
+	}
+	for _, name := range rs.Exact {
+		idx.domain.insert(name, i, matchSelf)
+	}
+	for _, name := range rs.Suffix {
+		idx.domain.insert(name, i, matchSuffix)
+	}
+	for _, name := range rs.Sub {
+		idx.domain.insert(name, i, matchSub)
+	}
+	for _, n := range rs.CIDR {
+		idx.insertCIDR(n, i)
+	}
+	if len(rs.Keyword) > 0 {
+		idx.keywords[i] = rs.Keyword
+		idx.linear = append(idx.linear, i)
+	}
+}
+
+// insertCIDR 插入网段
+func (idx *hostIndex) insertCIDR(n *net.IPNet, i int) {
+	ones, _ := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil {
+		idx.ipv4.insert(ip4, ones, i)
+	} else {
+		idx.ipv6.insert(n.IP.To16(), ones, i)
+	}
+}
+
+// insertIP ip按单个地址的网段插入
+func (idx *hostIndex) insertIP(ip net.IP, i int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		idx.ipv4.insert(ip4, 32, i)
+	} else {
+		idx.ipv6.insert(ip.To16(), 128, i)
+	}
+}
+
+// lookupIP 查询ip规则
+func (idx *hostIndex) lookupIP(addr string, fn func([]int)) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		idx.ipv4.lookup(ip4, fn)
+	} else {
+		idx.ipv6.lookup(ip.To16(), fn)
+	}
+}
+
+// lookup 返回最先配置的命中规则及序号，未命中时序号为-1，user为空时只匹配不限用户的规则
+func (idx *hostIndex) lookup(dstName, dstIP string, dstPort uint16, srcIP, user string) (conf.Host, int) {
+	best := len(idx.hosts)
+	allowed := func(i int) bool {
+		h := idx.hosts[i]
+		if len(h.User) > 0 && !inStrings(h.User, user) {
+			return false
+		}
+		return h.MatchCond(dstPort, srcIP)
+	}
+	// 各索引内的规则序号都是递增的，取第一个可用的和当前结果比较
+	consider := func(list []int) {
+		for _, i := range list {
+			if i >= best {
+				return
+			}
+			if allowed(i) {
+				best = i
+				return
+			}
+		}
+	}
+
+	consider(idx.exact[dstName])
+	if dstIP != dstName {
+		consider(idx.exact[dstIP])
+	}
+	if dstName != "" {
+		idx.domain.lookup(strings.ToLower(strings.TrimSuffix(dstName, ".")), consider)
+	}
+	idx.lookupIP(dstName, consider)
+	if dstIP != dstName {
+		idx.lookupIP(dstIP, consider)
+	}
+	for _, i := range idx.linear {
+		if i >= best {
+			break
+		}
+		if allowed(i) && idx.matchLinear(i, dstName, dstIP) {
+			best = i
+			break
+		}
+	}
+
+	if best == len(idx.hosts) {
+		return conf.Host{}, -1
+	}
+	return idx.hosts[best], best
+}
+
+// matchLinear 无法索引的规则逐条比对
+func (idx *hostIndex) matchLinear(i int, dstName, dstIP string) bool {
+	h := idx.hosts[i]
+	switch idx.match[i] {
+	case "any":
+		return true
+	case "ruleset":
+		name := strings.ToLower(dstName)
+		for _, k := range idx.keywords[i] {
+			if strings.Contains(name, k) {
+				return true
+			}
+		}
+	case "contain":
+		return strings.Contains(dstName, h.Name) || strings.Contains(dstIP, h.Name)
+	case "preg", "glob":
+		// 正则在加载配置时已编译
+		re := h.Pattern()
+		if re == nil {
+			return false
+		}
+		return (dstName != "" && re.MatchString(dstName)) || (dstIP != "" && re.MatchString(dstIP))
+	}
+	return false
+}
+
+// 域名树的匹配方式
+const (
+	matchSuffix = iota // 匹配自身及子域名
+	matchSub           // 只匹配子域名
+	matchSelf          // 只匹配自身
+)
+
+// domainNode 按域名从右到左逐级的前缀树
+type domainNode struct {
+	children  map[string]*domainNode
+	rules     []int // 匹配自身及子域名
+	subRules  []int // 只匹配子域名
+	selfRules []int // 只匹配自身
+}
+
+func newDomainNode() *domainNode {
+	return &domainNode{children: make(map[string]*domainNode)}
+}
+
+// insert 插入域名
+func (n *domainNode) insert(name string, i int, mode int) {
+	labels := strings.Split(name, ".")
+	for j := len(labels) - 1; j >= 0; j-- {
+		child, ok := n.children[labels[j]]
+		if !ok {
+			child = newDomainNode()
+			n.children[labels[j]] = child
+		}
+		n = child
+	}
+	// 同一条规则重复插入时只保留一次，保持序号递增
+	switch mode {
+	case matchSub:
+		n.subRules = appendRule(n.subRules, i)
+	case matchSelf:
+		n.selfRules = appendRule(n.selfRules, i)
+	default:
+		n.rules = appendRule(n.rules, i)
+	}
+}
+
+// appendRule 规则序号按插入顺序递增，和最后一个相同时不重复添加
+func appendRule(list []int, i int) []int {
+	if len(list) > 0 && list[len(list)-1] == i {
+		return list
+	}
+	return append(list, i)
+}
+
+// lookup 依次返回路径上命中的规则
+func (n *domainNode) lookup(name string, fn func([]int)) {
+	labels := strings.Split(name, ".")
+	for j := len(labels) - 1; j >= 0; j-- {
+		child, ok := n.children[labels[j]]
+		if !ok {
+			return
+		}
+		n = child
+		fn(n.rules)
+		if j > 0 {
+			fn(n.subRules)
+		} else {
+			fn(n.selfRules)
+		}
+	}
+}
+
+// cidrNode 按位的ip前缀树
+type cidrNode struct {
+	children [2]*cidrNode
+	rules    []int
+}
+
+// insert 插入网段，ip为4或16字节
+func (n *cidrNode) insert(ip net.IP, ones int, i int) {
+	for b := 0; b < ones; b++ {
+		bit := ip[b/8] >> (7 - uint(b%8)) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &cidrNode{}
+		}
+		n = n.children[bit]
+	}
+	n.rules = appendRule(n.rules, i)
+}
+
+// lookup 依次返回包含该ip的网段上的规则
+func (n *cidrNode) lookup(ip net.IP, fn func([]int)) {
+	fn(n.rules)
+	for b := 0; b < len(ip)*8; b++ {
+		n = n.children[ip[b/8]>>(7-uint(b%8))&1]
+		if n == nil {
+			return
+		}
+		fn(n.rules)
+	}
+}
@@ -0,0 +1,207 @@
+package proto
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// loadRouter 从yaml生成配置，正则和网段在加载时编译
+func loadRouter(tb testing.TB, data string) *conf.Router {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "router.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	cnf, err := conf.LoadRouterConfig(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &cnf
+}
+
+// linearLookup 按配置顺序逐条比对，作为索引的对照
+func linearLookup(cnf *conf.Router, dstName, dstIP string) int {
+	for i, h := range cnf.Hosts {
+		switch getString(h.Match, cnf.Default.Match, "equal") {
+		case "equal":
+			if h.Name == dstName || h.Name == dstIP {
+				return i
+			}
+		case "contain":
+			if strings.Contains(dstName, h.Name) || strings.Contains(dstIP, h.Name) {
+				return i
+			}
+		case "suffix":
+			suffix := strings.TrimPrefix(h.Name, ".")
+			if dstName == suffix || strings.HasSuffix(dstName, "."+suffix) {
+				return i
+			}
+		case "preg", "glob":
+			if re := h.Pattern(); re != nil && ((dstName != "" && re.MatchString(dstName)) || (dstIP != "" && re.MatchString(dstIP))) {
+				return i
+			}
+		case "cidr":
+			for _, addr := range []string{dstName, dstIP} {
+				if ip := net.ParseIP(addr); ip != nil && h.CIDR().Contains(ip) {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+const firstMatchConfig = `
+hosts:
+  - name: cdn
+    match: contain
+  - name: ^api\..*\.com$
+    match: preg
+  - name: img.cdn.example.com
+  - name: example.com
+    match: suffix
+  - name: 10.0.0.0/8
+    match: cidr
+  - name: www.example.com
+  - name: 10.1.2.3
+  - name: api.example.com
+  - name: "*.test.org"
+    match: glob
+  - name: test.org
+  - name: a.test.org
+  - name: other
+    match: contain
+  - name: other.net
+  - name: 192.168.1.1
+  - name: 192.168.0.0/16
+    match: cidr
+  - name: db.example.org
+    ports: ["3306"]
+  - name: db.example.org
+`
+
+func TestLookupFirstMatchWins(t *testing.T) {
+	cnf := loadRouter(t, firstMatchConfig)
+	idx := newHostIndex(cnf)
+	tests := []struct {
+		name    string
+		dstName string
+		dstIP   string
+		port    uint16
+		want    int
+	}{
+		{"contain before exact", "img.cdn.example.com", "", 80, 0},
+		{"preg before suffix and exact", "api.example.com", "", 80, 1},
+		{"suffix before exact", "www.example.com", "", 80, 3},
+		{"suffix self", "example.com", "", 80, 3},
+		{"cidr before exact ip", "10.1.2.3", "", 80, 4},
+		{"cidr on resolved ip", "host.internal", "10.9.9.9", 80, 4},
+		{"glob sub before exact", "a.test.org", "", 80, 8},
+		{"glob sub not self", "test.org", "", 80, 9},
+		{"contain after index miss", "other.net", "", 80, 11},
+		{"exact ip before cidr", "192.168.1.1", "", 80, 13},
+		{"cidr", "192.168.2.2", "", 80, 14},
+		{"port condition", "db.example.org", "", 3306, 15},
+		{"port condition fallthrough", "db.example.org", "", 5432, 16},
+		{"no match", "nomatch.io", "", 80, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := idx.lookup(tt.dstName, tt.dstIP, tt.port, "", "")
+			if got != tt.want {
+				t.Fatalf("lookup(%q, %q) = %d, want %d", tt.dstName, tt.dstIP, got, tt.want)
+			}
+			if tt.port == 80 {
+				if linear := linearLookup(cnf, tt.dstName, tt.dstIP); linear != tt.want {
+					t.Fatalf("linear scan = %d, want %d", linear, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCurrentIndexPerSnapshot(t *testing.T) {
+	old := loadRouter(t, firstMatchConfig)
+	cnf := loadRouter(t, firstMatchConfig)
+	// 新旧快照交替使用时各自只生成一次
+	idxOld, idx := currentIndex(old), currentIndex(cnf)
+	for i := 0; i < 3; i++ {
+		if currentIndex(old) != idxOld || currentIndex(cnf) != idx {
+			t.Fatal("index rebuilt for the same snapshot")
+		}
+	}
+	if idxOld == idx || idxOld.cnf != old {
+		t.Fatal("snapshots share an index")
+	}
+
+	// 超过保留数量时淘汰最早的
+	for i := 0; i < maxRuleIndexes; i++ {
+		currentIndex(loadRouter(t, firstMatchConfig))
+	}
+	ruleMu.RLock()
+	_, kept := ruleIndexes[old]
+	n := len(ruleIndexes)
+	ruleMu.RUnlock()
+	if kept || n > maxRuleIndexes {
+		t.Fatalf("indexes kept %d, old snapshot kept %v", n, kept)
+	}
+}
+
+// genRules 生成混合规则，每1000条有一条正则
+func genRules(n int) (string, []string) {
+	var b strings.Builder
+	b.WriteString("hosts:\n")
+	queries := []string{}
+	for i := 0; i < n; i++ {
+		switch {
+		case i%1000 == 999:
+			fmt.Fprintf(&b, "  - name: ^re%d\\..*\\.io$\n    match: preg\n", i)
+			queries = append(queries, fmt.Sprintf("re%d.x.io", i))
+		case i%10 < 6:
+			fmt.Fprintf(&b, "  - name: host%d.example%d.com\n", i, i%97)
+			queries = append(queries, fmt.Sprintf("host%d.example%d.com", i, i%97))
+		case i%10 < 8:
+			fmt.Fprintf(&b, "  - name: zone%d.net\n    match: suffix\n", i)
+			queries = append(queries, fmt.Sprintf("www.zone%d.net", i))
+		default:
+			fmt.Fprintf(&b, "  - name: 10.%d.%d.0/24\n    match: cidr\n", i/256%256, i%256)
+			queries = append(queries, fmt.Sprintf("10.%d.%d.7", i/256%256, i%256))
+		}
+	}
+	queries = append(queries, "miss.example.com", "172.16.0.1")
+	return b.String(), queries
+}
+
+func TestLookupMatchesLinear(t *testing.T) {
+	data, queries := genRules(3000)
+	cnf := loadRouter(t, data)
+	idx := newHostIndex(cnf)
+	for _, q := range queries {
+		_, got := idx.lookup(q, "", 0, "", "")
+		if want := linearLookup(cnf, q, ""); got != want {
+			t.Fatalf("lookup(%q) = %d, linear scan = %d", q, got, want)
+		}
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	data, queries := genRules(30000)
+	cnf := loadRouter(b, data)
+	idx := newHostIndex(cnf)
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			idx.lookup(queries[i%len(queries)], "", 0, "", "")
+		}
+	})
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearLookup(cnf, queries[i%len(queries)], "")
+		}
+	})
+}
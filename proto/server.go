@@ -2,16 +2,35 @@ package proto
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
+	"time"
 
+	"github.com/keminar/anyproxy/utils/conf"
 	"github.com/keminar/anyproxy/utils/trace"
 )
 
 // ServerHandler 服务端处理
 func ServerHandler(ctx context.Context, tcpConn *net.TCPConn) error {
-	req := NewRequest(ctx, tcpConn)
+	var conn net.Conn = tcpConn
+	cnf := conf.Current()
+	tlsConf, err := tunnelServerTLS(cnf)
+	if err != nil {
+		return err
+	}
+	if tlsConf != nil {
+		// 配置了证书只接受TLS连接
+		tlsConn := tls.Server(tcpConn, tlsConf)
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err = tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	req := newRequest(ctx, conn, cnf)
 
 	// test if the underlying fd is nil
 	remoteAddr := tcpConn.RemoteAddr()
@@ -35,5 +54,9 @@ func ServerHandler(ctx context.Context, tcpConn *net.TCPConn) error {
 	if !ok || stream.Method != "CONNECT" {
 		return errors.New("Not CONNECT method")
 	}
+	if !allowTarget(stream.token.Allow, req.DstName) {
+		log.Println(trace.ID(req.ID), "token", stream.token.Name, "deny", req.DstName)
+		return errors.New("Target not allowed for token")
+	}
 	return req.Stream.response()
 }
@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+
+	"github.com/keminar/anyproxy/proto/tcp"
+)
+
+const (
+	tlsRecordHandshake    = 0x16
+	tlsHandshakeHello     = 0x01
+	tlsExtServerName      = 0x0000
+	tlsServerNameTypeHost = 0x00
+)
+
+// sniffHost 从已缓存的首包中识别域名, 先看TLS的SNI再看HTTP的Host
+// 只用Peek不移动读取位置，后面转发时数据原样补发
+func sniffHost(reader *tcp.Reader) string {
+	head, err := reader.Peek(1)
+	if err != nil || len(head) == 0 {
+		return ""
+	}
+	if head[0] == tlsRecordHandshake {
+		return sniffTLSServerName(reader)
+	}
+	data, _ := reader.Peek(reader.Buffered())
+	return sniffHTTPHost(data)
+}
+
+// sniffTLSServerName 解析TLS ClientHello中的server_name
+func sniffTLSServerName(reader *tcp.Reader) string {
+	header, err := reader.Peek(5)
+	if err != nil || len(header) < 5 {
+		return ""
+	}
+	// 记录层: type(1) version(2) length(2)
+	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+	want := 5 + recordLen
+	if want > reader.Size() {
+		want = reader.Size()
+	}
+	// ClientHello超出缓存时用已读部分，server_name一般比较靠前
+	data, _ := reader.Peek(want)
+	if len(data) <= 5 {
+		return ""
+	}
+	return parseClientHello(data[5:])
+}
+
+// parseClientHello 解析握手消息，数据不完整时返回空
+func parseClientHello(data []byte) string {
+	// 握手层: type(1) length(3)
+	if len(data) < 4 || data[0] != tlsHandshakeHello {
+		return ""
+	}
+	// version(2) random(32)
+	pos := 4 + 2 + 32
+	if len(data) < pos+1 {
+		return ""
+	}
+	// session id
+	pos += 1 + int(data[pos])
+	if len(data) < pos+2 {
+		return ""
+	}
+	// cipher suites
+	pos += 2 + int(binary.BigEndian.Uint16(data[pos:pos+2]))
+	if len(data) < pos+1 {
+		return ""
+	}
+	// compression methods
+	pos += 1 + int(data[pos])
+	if len(data) < pos+2 {
+		return ""
+	}
+	extEnd := pos + 2 + int(binary.BigEndian.Uint16(data[pos:pos+2]))
+	pos += 2
+	if extEnd > len(data) {
+		extEnd = len(data)
+	}
+	for pos+4 <= extEnd {
+		extType := binary.BigEndian.Uint16(data[pos : pos+2])
+		extLen := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		pos += 4
+		if pos+extLen > extEnd {
+			return ""
+		}
+		if extType == tlsExtServerName {
+			return parseServerNameExt(data[pos : pos+extLen])
+		}
+		pos += extLen
+	}
+	return ""
+}
+
+// parseServerNameExt 取server_name扩展中的host_name
+func parseServerNameExt(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	listEnd := 2 + int(binary.BigEndian.Uint16(data[0:2]))
+	if listEnd > len(data) {
+		return ""
+	}
+	pos := 2
+	for pos+3 <= listEnd {
+		nameType := data[pos]
+		nameLen := int(binary.BigEndian.Uint16(data[pos+1 : pos+3]))
+		pos += 3
+		if pos+nameLen > listEnd {
+			return ""
+		}
+		if nameType == tlsServerNameTypeHost {
+			return validHostName(string(data[pos : pos+nameLen]))
+		}
+		pos += nameLen
+	}
+	return ""
+}
+
+// sniffHTTPHost 从明文HTTP请求头部中取Host
+func sniffHTTPHost(data []byte) string {
+	lines := bytes.Split(data, []byte("\n"))
+	// 第一行是请求行，跳过
+	for i := 1; i < len(lines); i++ {
+		line := bytes.TrimRight(lines[i], "\r")
+		if len(line) == 0 {
+			break
+		}
+		idx := bytes.IndexByte(line, ':')
+		if idx < 0 {
+			continue
+		}
+		if !strings.EqualFold(string(bytes.TrimSpace(line[:idx])), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[idx+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validHostName(host)
+	}
+	return ""
+}
+
+// validHostName 只接受域名，ip或非法字符返回空
+func validHostName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return ""
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' {
+			continue
+		}
+		return ""
+	}
+	return name
+}
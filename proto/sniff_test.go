@@ -0,0 +1,104 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/keminar/anyproxy/proto/tcp"
+)
+
+// captureClientHello 用crypto/tls生成真实的ClientHello记录
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Handshake()
+		client.Close()
+	}()
+	server.SetDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func TestSniffHostTLS(t *testing.T) {
+	record := captureClientHello(t, "www.example.com")
+	if got := sniffHost(tcp.NewReader(bytes.NewReader(record))); got != "www.example.com" {
+		t.Fatalf("sniffHost = %q, want www.example.com", got)
+	}
+
+	// 每个长度字段处截断都不能panic，server_name读完整之前都返回空
+	hello := record[5:]
+	end := bytes.Index(hello, []byte("www.example.com")) + len("www.example.com")
+	for i := 0; i < len(hello); i++ {
+		got := parseClientHello(hello[:i])
+		if i < end && got != "" {
+			t.Fatalf("truncated at %d: got %q", i, got)
+		}
+	}
+	for i := 0; i < len(record); i++ {
+		sniffHost(tcp.NewReader(bytes.NewReader(record[:i])))
+	}
+}
+
+func TestSniffHostTLSNoSNI(t *testing.T) {
+	// tls不为ip地址发送SNI
+	record := captureClientHello(t, "127.0.0.1")
+	if got := sniffHost(tcp.NewReader(bytes.NewReader(record))); got != "" {
+		t.Fatalf("sniffHost without SNI = %q", got)
+	}
+}
+
+func TestParseClientHelloBogus(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":           {},
+		"not hello":       {0x02, 0, 0, 0},
+		"session overrun": append(append([]byte{0x01, 0, 0, 0}, make([]byte, 34)...), 0xff),
+		"cipher overrun":  append(append([]byte{0x01, 0, 0, 0}, make([]byte, 35)...), 0xff, 0xff),
+		"ext overrun":     append(append([]byte{0x01, 0, 0, 0}, make([]byte, 35)...), 0, 0, 0, 0, 8, 0, 0, 0, 0xff),
+	}
+	for name, data := range tests {
+		if got := parseClientHello(data); got != "" {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+	for _, data := range [][]byte{{0}, {0, 9, 0}, {0, 3, 0, 0, 9}} {
+		if got := parseServerNameExt(data); got != "" {
+			t.Errorf("parseServerNameExt(%v) = %q", data, got)
+		}
+	}
+}
+
+func TestSniffHTTPHost(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"GET / HTTP/1.1\r\nHost: www.Example.com:8080\r\n\r\n", "www.example.com"},
+		{"GET / HTTP/1.1\r\nhost:a.b\r\n\r\n", "a.b"},
+		{"GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: evil.com/<script>\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: \r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nX: y\r\n\r\nHost: body.com\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost", ""},
+		{"Host: first.line\r\n", ""},
+	}
+	for _, tt := range tests {
+		if got := sniffHost(tcp.NewReader(bytes.NewReader([]byte(tt.data)))); got != tt.want {
+			t.Errorf("sniffHost(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/keminar/anyproxy/utils/trace"
+)
+
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+
+	socks4ReplyVersion = 0x00
+	socks4Granted      = 0x5A
+	socks4Rejected     = 0x5B
+)
+
+type socks4Stream struct {
+	req    *Request
+	userID string // 客户端标识，socks4没有密码不做认证使用
+}
+
+func newSocks4Stream(req *Request) *socks4Stream {
+	c := &socks4Stream{
+		req: req,
+	}
+	return c
+}
+
+func (that *socks4Stream) validHead() bool {
+	if that.req.reader.Buffered() < 2 {
+		return false
+	}
+
+	tmpBuf, err := that.req.reader.Peek(2)
+	if err != nil {
+		return false
+	}
+	return tmpBuf[0] == socks4Version && (tmpBuf[1] == socks4CmdConnect || tmpBuf[1] == socks4CmdBind)
+}
+
+func (that *socks4Stream) readRequest(from string) (canProxy bool, err error) {
+	if err = that.ParseHeader(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ParseHeader 解析socks4/socks4a请求
+func (that *socks4Stream) ParseHeader() error {
+	/**
+	  +----+----+----+----+----+----+----+----+----+----+....+----+
+	  | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	  +----+----+----+----+----+----+----+----+----+----+....+----+
+	     1    1      2              4           variable       1
+	*/
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(that.req.reader, header); err != nil {
+		return err
+	}
+	userID, err := that.readString()
+	if err != nil {
+		return err
+	}
+	that.userID = userID
+
+	if header[1] != socks4CmdConnect {
+		that.reply(socks4Rejected)
+		return fmt.Errorf("socks4 command %d is not supported", header[1])
+	}
+	// socks4没有密码，开启了socks5认证时不允许使用
+	if len(that.req.cnf.Socks5.Users) > 0 {
+		that.reply(socks4Rejected)
+		return errors.New("socks4 is not allowed when socks5 users is set")
+	}
+
+	that.req.DstPort = binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+	// socks4a: DSTIP为0.0.0.x(x不为0)时，USERID后面跟着域名
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		that.req.DstName, err = that.readString()
+		if err != nil {
+			return err
+		}
+		if that.req.DstName == "" {
+			that.reply(socks4Rejected)
+			return errors.New("socks4a domain is empty")
+		}
+	} else {
+		that.req.DstIP = ip.String()
+	}
+	return nil
+}
+
+// readString 读取以NULL结尾的字符串
+func (that *socks4Stream) readString() (string, error) {
+	line, err := that.req.reader.ReadSlice(0x00)
+	if err != nil {
+		return "", err
+	}
+	return string(line[:len(line)-1]), nil
+}
+
+// reply 发送应答, 端口和地址客户端会忽略
+func (that *socks4Stream) reply(cd byte) error {
+	_, err := that.req.conn.Write([]byte{socks4ReplyVersion, cd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
+
+func (that *socks4Stream) response() error {
+	tunnel := newTunnel(that.req)
+
+	that.showIP()
+	err := tunnel.handshake(protoTCP, that.req.DstName, that.req.DstIP, that.req.DstPort)
+	if err != nil {
+		log.Println(trace.ID(that.req.ID), "handshake err", err.Error())
+		that.reply(socks4Rejected)
+		return err
+	}
+
+	// 连上后端后再发送应答
+	err = that.reply(socks4Granted)
+	if err != nil {
+		log.Println(trace.ID(that.req.ID), "write err", err.Error())
+		return err
+	}
+
+	tunnel.transfer(-1)
+	return nil
+}
+
+func (that *socks4Stream) showIP() {
+	from := that.req.conn.RemoteAddr().String()
+	if that.userID != "" {
+		from = that.userID + "@" + from
+	}
+	if that.req.DstName != "" {
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks4", from, that.req.DstName, that.req.DstPort))
+	} else {
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks4", from, that.req.DstIP, that.req.DstPort))
+	}
+}
@@ -9,12 +9,49 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"syscall"
 
+	"github.com/keminar/anyproxy/utils/conf"
 	"github.com/keminar/anyproxy/utils/trace"
 )
 
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthUserPass    = 0x02
+	socks5AuthNoAccept    = 0xFF
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+)
+
+const (
+	socks5CmdConnect = 0x01
+	socks5CmdBind    = 0x02
+	socks5CmdUDP     = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+)
+
+const (
+	socks5RepSuccess          = 0x00
+	socks5RepFailure          = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepNetUnreachable   = 0x03
+	socks5RepHostUnreachable  = 0x04
+	socks5RepConnRefused      = 0x05
+	socks5RepTTLExpired       = 0x06
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAddrNotSupported = 0x08
+)
+
+var errSocks5AddrType = errors.New("socks5 address type is not supported")
+
 type socks5Stream struct {
 	req *Request
+	cmd byte // 请求命令
 }
 
 func newSocks5Stream(req *Request) *socks5Stream {
@@ -34,12 +71,7 @@ func (that *socks5Stream) validHead() bool {
 		return false
 	}
 
-	isSocks5 := len(tmpBuf) >= 2 && tmpBuf[0] == 0x05
-	if isSocks5 {
-		// 如果是SOCKS5则把已读信息从缓存区释放掉
-		that.req.reader.UnreadBuf(-1)
-	}
-	return isSocks5
+	return len(tmpBuf) >= 2 && tmpBuf[0] == socks5Version
 }
 
 func (that *socks5Stream) readRequest(from string) (canProxy bool, err error) {
@@ -50,20 +82,23 @@ func (that *socks5Stream) readRequest(from string) (canProxy bool, err error) {
 }
 
 func (that *socks5Stream) response() error {
+	if that.cmd == socks5CmdUDP {
+		return newSocks5UDP(that.req).associate(that)
+	}
 	tunnel := newTunnel(that.req)
 
-	var err error
-	// 发送socks5应答
-	_, err = that.req.conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	that.showIP()
+	err := tunnel.handshake(protoTCP, that.req.DstName, that.req.DstIP, that.req.DstPort)
 	if err != nil {
-		log.Println(trace.ID(that.req.ID), "write err", err.Error())
+		log.Println(trace.ID(that.req.ID), "handshake err", err.Error())
+		that.reply(socks5ReplyCode(err), nil)
 		return err
 	}
 
-	that.showIP()
-	err = tunnel.handshake(protoTCP, that.req.DstName, that.req.DstIP, that.req.DstPort)
+	// 连上后端后再发送socks5应答，带上实际的绑定地址
+	err = that.reply(socks5RepSuccess, tunnel.conn.LocalAddr())
 	if err != nil {
-		log.Println(trace.ID(that.req.ID), "handshake err", err.Error())
+		log.Println(trace.ID(that.req.ID), "write err", err.Error())
 		return err
 	}
 
@@ -72,10 +107,14 @@ func (that *socks5Stream) response() error {
 }
 
 func (that *socks5Stream) showIP() {
+	from := that.req.conn.RemoteAddr().String()
+	if that.req.User != "" {
+		from = that.req.User + "@" + from
+	}
 	if that.req.DstName != "" {
-		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks5", that.req.conn.RemoteAddr().String(), that.req.DstName, that.req.DstPort))
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks5", from, that.req.DstName, that.req.DstPort))
 	} else {
-		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks5", that.req.conn.RemoteAddr().String(), that.req.DstIP, that.req.DstPort))
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", "Socks5", from, that.req.DstIP, that.req.DstPort))
 	}
 }
 
@@ -83,7 +122,7 @@ func (that *socks5Stream) showIP() {
 func (that *socks5Stream) ParseHeader() error {
 	// response to socks5 client
 	// see rfc 1982 for more details (https://tools.ietf.org/html/rfc1928)
-	n, err := that.req.conn.Write([]byte{0x05, 0x00}) // version and no authentication required
+	err := that.negotiate()
 	if err != nil {
 		return err
 	}
@@ -96,53 +135,200 @@ func (that *socks5Stream) ParseHeader() error {
 	  | 1  |  1  | X'00' |  1   | Variable |    2     |
 	  +----+-----+-------+------+----------+----------+
 	*/
-	var buffer [1024]byte
-	n, err = that.req.reader.Read(buffer[:])
-	if err != nil {
+	header := make([]byte, 3)
+	if _, err = io.ReadFull(that.req.reader, header); err != nil {
 		return err
 	}
-	if n < 6 {
-		return errors.New("not a socks protocol")
+	if header[0] != socks5Version {
+		return fmt.Errorf("socks5 request version %d is error", header[0])
 	}
+	that.cmd = header[1]
 
-	switch buffer[3] {
-	case 0x01:
-		// ipv4 address
-		ipv4 := make([]byte, 4)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[4:]), ipv4, len(ipv4)); err != nil {
-			return err
-		}
-		//fmt.Println(1)
-		that.req.DstIP = net.IP(ipv4).String()
-	case 0x04:
-		// ipv6
-		ipv6 := make([]byte, 16)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[4:]), ipv6, len(ipv6)); err != nil {
-			return err
-		}
-		that.req.DstIP = net.IP(ipv6).String()
-	case 0x03:
-		// domain
-		addrLen := int(buffer[4])
-		domain := make([]byte, addrLen)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[5:]), domain, addrLen); err != nil {
-			return err
+	that.req.DstName, that.req.DstIP, that.req.DstPort, err = readSocks5Addr(that.req.reader)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrType) {
+			that.reply(socks5RepAddrNotSupported, nil)
 		}
-		//fmt.Println(2)
-		that.req.DstName = string(domain)
+		return err
 	}
 
-	port := make([]byte, 2)
-	err = binary.Read(bytes.NewReader(buffer[n-2:n]), binary.BigEndian, &port)
-	if err != nil {
+	switch that.cmd {
+	case socks5CmdConnect, socks5CmdUDP:
+	default:
+		// BIND 等命令不支持
+		that.reply(socks5RepCmdNotSupported, nil)
+		return fmt.Errorf("socks5 command %d is not supported", that.cmd)
+	}
+	return nil
+}
+
+// reply 发送应答，addr为nil时用0地址
+func (that *socks5Stream) reply(rep byte, addr net.Addr) error {
+	/**
+	  +----+-----+-------+------+----------+----------+
+	  |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+	  +----+-----+-------+------+----------+----------+
+	  | 1  |  1  | X'00' |  1   | Variable |    2     |
+	  +----+-----+-------+------+----------+----------+
+	*/
+	host, port := "0.0.0.0", 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		host, port = a.IP.String(), a.Port
+	case *net.UDPAddr:
+		host, port = a.IP.String(), a.Port
+	}
+	_, err := that.req.conn.Write(append([]byte{socks5Version, rep, 0x00}, socks5Addr(host, uint16(port))...))
+	return err
+}
+
+// socks5ReplyCode 按连接错误取应答码
+func socks5ReplyCode(err error) byte {
+	var deny denyError
+	if errors.As(err, &deny) {
+		return socks5RepNotAllowed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socks5RepConnRefused
+	}
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return socks5RepNetUnreachable
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) {
+		return socks5RepHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5RepHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5RepTTLExpired
+	}
+	return socks5RepFailure
+}
+
+// negotiate 协商认证方式，配置了用户则必须用户名密码认证
+func (that *socks5Stream) negotiate() error {
+	/**
+	  +----+----------+----------+
+	  |VER | NMETHODS | METHODS  |
+	  +----+----------+----------+
+	  | 1  |    1     | 1 to 255 |
+	  +----+----------+----------+
+	*/
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(that.req.reader, header); err != nil {
+		return err
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(that.req.reader, methods); err != nil {
 		return err
 	}
 
-	portStr := strconv.Itoa((int(port[0]) << 8) | int(port[1]))
-	c, err := strconv.ParseUint(portStr, 0, 16)
-	if err != nil {
+	users := that.req.cnf.Socks5.Users
+	if len(users) == 0 {
+		_, err := that.req.conn.Write([]byte{socks5Version, socks5AuthNone}) // version and no authentication required
 		return err
 	}
-	that.req.DstPort = uint16(c)
-	return nil
+	if bytes.IndexByte(methods, socks5AuthUserPass) < 0 {
+		that.req.conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return errors.New("socks5 client does not support username/password auth")
+	}
+	if _, err := that.req.conn.Write([]byte{socks5Version, socks5AuthUserPass}); err != nil {
+		return err
+	}
+	return that.authUserPass(users)
+}
+
+// authUserPass 用户名密码认证 rfc1929
+func (that *socks5Stream) authUserPass(users []conf.User) error {
+	/**
+	  +----+------+----------+------+----------+
+	  |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	  +----+------+----------+------+----------+
+	  | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	  +----+------+----------+------+----------+
+	*/
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(that.req.reader, header); err != nil {
+		return err
+	}
+	if header[0] != socks5UserPassVersion {
+		return fmt.Errorf("socks5 auth version %d is error", header[0])
+	}
+	name := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(that.req.reader, name); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(that.req.reader, header[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, int(header[0]))
+	if _, err := io.ReadFull(that.req.reader, pass); err != nil {
+		return err
+	}
+
+	if !checkUser(users, string(name), string(pass)) {
+		that.req.conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+		return fmt.Errorf("socks5 user %s auth fail", strconv.Quote(string(name)))
+	}
+	that.req.User = string(name)
+	_, err := that.req.conn.Write([]byte{socks5UserPassVersion, socks5UserPassSuccess})
+	return err
+}
+
+// socks5Addr 按ATYP格式编码地址和端口
+func socks5Addr(host string, port uint16) []byte {
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{socks5AtypIPv4}, ip4...)
+		} else {
+			buf = append([]byte{socks5AtypIPv6}, ip.To16()...)
+		}
+	} else {
+		buf = append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// readSocks5Addr 按ATYP格式读取地址和端口, 域名放在name, ip放在ip
+func readSocks5Addr(r io.Reader) (name string, ip string, port uint16, err error) {
+	atyp := make([]byte, 1)
+	if _, err = io.ReadFull(r, atyp); err != nil {
+		return
+	}
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err = io.ReadFull(r, addr); err != nil {
+			return
+		}
+		ip = net.IP(addr).String()
+	case socks5AtypIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err = io.ReadFull(r, addr); err != nil {
+			return
+		}
+		ip = net.IP(addr).String()
+	case socks5AtypDomain:
+		if _, err = io.ReadFull(r, atyp); err != nil {
+			return
+		}
+		addr := make([]byte, int(atyp[0]))
+		if _, err = io.ReadFull(r, addr); err != nil {
+			return
+		}
+		name = string(addr)
+	default:
+		err = fmt.Errorf("%w %d", errSocks5AddrType, atyp[0])
+		return
+	}
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull(r, portBuf); err != nil {
+		return
+	}
+	port = binary.BigEndian.Uint16(portBuf)
+	return
 }
@@ -0,0 +1,552 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/utils/trace"
+)
+
+// UDP ASSOCIATE 空闲超时秒数
+const defaultUDPTimeout = 60
+
+// udp包最大长度
+const maxUDPPacket = 64 * 1024
+
+// maxUDPRoutes 一个关联最多保存的目标地址路由数，超出时淘汰最久未用的
+const maxUDPRoutes = 1024
+
+// socks5UDP 一个UDP ASSOCIATE关联, 生命周期和控制连接相同
+type socks5UDP struct {
+	req     *Request
+	relay   *net.UDPConn // 与客户端通信的中继端口
+	local   *net.UDPConn // 本地直连出口
+	timeout time.Duration
+
+	routes    map[string]*udpRoute    // 目标地址 => 路由，只在readClient中使用
+	upstreams map[string]*udpUpstream // 上游socks5地址 => 关联，只在readClient中使用
+	lastSweep time.Time               // 上次清理空闲路由的时间
+
+	mu      sync.Mutex
+	client  *net.UDPAddr         // 客户端udp地址，收到首个合法包后确定
+	replies map[string]*udpRoute // 回包地址 => 路由，直连的回包只接收这些地址的，并用于统计下行流量
+}
+
+// udpRoute 按hosts/default配置对某个目标地址的访问策略
+type udpRoute struct {
+	target    string       // local, remote, deny
+	addr      *net.UDPAddr // local时的目标地址
+	header    []byte       // remote时发给上游的udp头部
+	upstream  *udpUpstream
+	tunnel    *tunnel  // 访问控制和流量统计
+	replyKeys []string // 回包地址
+	lastUsed  time.Time
+}
+
+// udpUpstream 上游socks5服务的UDP关联
+type udpUpstream struct {
+	ctrl net.Conn // 控制连接，关闭后关联失效
+	conn *net.UDPConn
+}
+
+func newSocks5UDP(req *Request) *socks5UDP {
+	timeout := req.cnf.Socks5.UDPTimeout
+	if timeout <= 0 {
+		timeout = defaultUDPTimeout
+	}
+	return &socks5UDP{
+		req:       req,
+		timeout:   time.Duration(timeout) * time.Second,
+		routes:    make(map[string]*udpRoute),
+		upstreams: make(map[string]*udpUpstream),
+		replies:   make(map[string]*udpRoute),
+	}
+}
+
+// associate 开启中继端口并应答客户端，直到控制连接断开或空闲超时
+func (u *socks5UDP) associate(stream *socks5Stream) (err error) {
+	// 客户端要在tcp连接允许时才可以使用udp
+	if ip, ok := newTunnel(u.req).isAllowed([]string{}); !ok {
+		stream.reply(socks5RepNotAllowed, nil)
+		return denyError(fmt.Sprintf("%s is not allowed", ip))
+	}
+	localIP := u.req.conn.LocalAddr().(*net.TCPAddr).IP
+	u.relay, err = net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Println(trace.ID(u.req.ID), "udp listen err", err.Error())
+		stream.reply(socks5RepFailure, nil)
+		return
+	}
+	defer u.relay.Close()
+	u.local, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Println(trace.ID(u.req.ID), "udp listen err", err.Error())
+		stream.reply(socks5RepFailure, nil)
+		return
+	}
+	defer u.local.Close()
+	defer u.closeUpstreams()
+
+	bind := u.relay.LocalAddr().(*net.UDPAddr)
+	if err = stream.reply(socks5RepSuccess, bind); err != nil {
+		log.Println(trace.ID(u.req.ID), "write err", err.Error())
+		return
+	}
+	log.Println(trace.ID(u.req.ID), fmt.Sprintf("%s %s udp associate on %s", "Socks5", u.req.conn.RemoteAddr().String(), bind.String()))
+
+	// 控制连接断开时关联结束
+	go func() {
+		io.Copy(io.Discard, u.req.reader)
+		u.relay.Close()
+	}()
+	go u.readLocal()
+	u.readClient()
+	if config.DebugLevel >= config.LevelLong {
+		log.Println(trace.ID(u.req.ID), "udp associate finished")
+	}
+	return nil
+}
+
+// readClient 读取客户端的udp包并按路由转发
+func (u *socks5UDP) readClient() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		u.relay.SetReadDeadline(time.Now().Add(u.timeout))
+		n, from, err := u.relay.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				log.Println(trace.ID(u.req.ID), "udp associate idle timeout")
+			}
+			return
+		}
+		if !u.acceptClient(from) {
+			if config.DebugLevel >= config.LevelDebug {
+				log.Println(trace.ID(u.req.ID), "udp drop packet from", from.String())
+			}
+			continue
+		}
+		u.forward(buf[:n])
+	}
+}
+
+// acceptClient 只接收控制连接同一个IP发来的包，请求中指定了端口的还要端口相同
+func (u *socks5UDP) acceptClient(from *net.UDPAddr) bool {
+	clientIP := u.req.conn.RemoteAddr().(*net.TCPAddr).IP
+	if !from.IP.Equal(clientIP) {
+		return false
+	}
+	if u.req.DstPort != 0 && int(u.req.DstPort) != from.Port {
+		return false
+	}
+	u.mu.Lock()
+	u.client = from
+	u.mu.Unlock()
+	return true
+}
+
+// errUDPFragment 不支持分片，按rfc直接丢弃
+var errUDPFragment = errors.New("udp fragment is not supported")
+
+// udpHeader 生成udp包的头部
+func udpHeader(host string, port uint16) []byte {
+	return append([]byte{0x00, 0x00, 0x00}, socks5Addr(host, port)...)
+}
+
+// parseUDPHeader 拆出udp包头部中的地址和数据，分片的返回errUDPFragment
+func parseUDPHeader(p []byte) (dstName, dstIP string, dstPort uint16, data []byte, err error) {
+	/**
+	  +----+------+------+----------+----------+----------+
+	  |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	  +----+------+------+----------+----------+----------+
+	  | 2  |  1   |  1   | Variable |    2     | Variable |
+	  +----+------+------+----------+----------+----------+
+	*/
+	if len(p) < 4 {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	if p[2] != 0x00 {
+		err = errUDPFragment
+		return
+	}
+	r := bytes.NewReader(p[3:])
+	if dstName, dstIP, dstPort, err = readSocks5Addr(r); err != nil {
+		return
+	}
+	data = p[len(p)-r.Len():]
+	return
+}
+
+// forward 转发一个客户端udp包
+func (u *socks5UDP) forward(p []byte) {
+	dstName, dstIP, dstPort, data, err := parseUDPHeader(p)
+	if err != nil {
+		if err != errUDPFragment {
+			log.Println(trace.ID(u.req.ID), "udp header err", err.Error())
+		}
+		return
+	}
+
+	key := net.JoinHostPort(dstName+dstIP, strconv.Itoa(int(dstPort)))
+	route, ok := u.routes[key]
+	if !ok {
+		u.expireRoutes()
+		route = u.newRoute(dstName, dstIP, dstPort)
+		u.routes[key] = route
+	}
+	route.lastUsed = time.Now()
+
+	var n int
+	switch route.target {
+	case "local":
+		n, err = u.local.WriteToUDP(data, route.addr)
+	case "remote":
+		n, err = route.upstream.conn.Write(append(route.header, data...))
+		n -= len(route.header)
+	default:
+		return
+	}
+	if err != nil {
+		log.Println(trace.ID(u.req.ID), "udp write err", err.Error())
+		// 上游关联失效后重新建立
+		u.removeRoute(key, route)
+		if route.upstream != nil {
+			u.removeUpstream(route.upstream)
+		}
+		return
+	}
+	if n > 0 {
+		route.tunnel.inbountCounter.Add(int64(n))
+	}
+}
+
+// newRoute 复用tcp的hosts/default配置决定目标地址的访问方式
+// 暂时只支持local和deny，上游是socks5时支持remote
+func (u *socks5UDP) newRoute(dstName, dstIP string, dstPort uint16) *udpRoute {
+	t := newTunnel(u.req)
+	route := &udpRoute{target: "deny", tunnel: t}
+	host, _, confTarget, confDNS, err := t.getRoute(protoUDP, dstName, dstIP, dstPort)
+	if err != nil {
+		log.Println(trace.ID(u.req.ID), "udp", err.Error())
+		return route
+	}
+	if host.IP != "" {
+		dstIP = host.IP
+	} else if dstName != "" && confDNS != "remote" {
+		dstIP = ""
+		if ips := t.lookup(dstName, confDNS, host.Prefer); len(ips) > 0 {
+			dstIP = ips[0].String()
+		}
+	}
+	for _, p := range host.Port {
+		if p.From == dstPort {
+			dstPort = p.To
+			break
+		}
+	}
+	if confTarget == "deny" {
+		log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp deny visit %s (%s)", dstName, dstIP))
+		return route
+	}
+
+	dst := dstName
+	if dst == "" {
+		dst = dstIP
+	}
+	up, confTarget, err := t.getProxy(host, confTarget, dst)
+	if err != nil {
+		log.Println(trace.ID(u.req.ID), "udp", err.Error())
+		return route
+	}
+	if up.server != "" && up.port > 0 && confTarget == "remote" {
+		if up.scheme != "socks5" {
+			log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp deny visit %s (%s), proxy scheme %s not support udp", dstName, dstIP, up.scheme))
+			return route
+		}
+		if up, err = t.claimProxy(host, dst, up); err != nil {
+			log.Println(trace.ID(u.req.ID), "udp", err.Error())
+			return route
+		}
+		network, connAddr := t.buildAddress(up.server, "", up.port, false)
+		upstream, err := u.getUpstream(network, connAddr, up.user)
+		// 记录代理的连接结果，udp不重试
+		if t.member != nil {
+			if err != nil && upstreamFault(err) {
+				t.member.brk.failure(getBreakerConf(u.req.cnf))
+			} else {
+				t.member.brk.success()
+			}
+		}
+		if err != nil {
+			log.Println(trace.ID(u.req.ID), "udp upstream err", err.Error())
+			return route
+		}
+		targetAddr := dstIP
+		if (confDNS == "remote" && dstName != "") || dstIP == "" {
+			targetAddr = dstName
+		}
+		route.header = udpHeader(targetAddr, dstPort)
+		route.upstream = upstream
+		route.target = "remote"
+		t.registerCounter(dstName, dstIP, dstPort)
+		// 上游回包的地址是ip，发送域名时按解析结果记录
+		replyIPs := []string{targetAddr}
+		if net.ParseIP(targetAddr) == nil {
+			replyIPs = replyIPs[:0]
+			for _, ip := range t.lookup(dstName, confDNS, host.Prefer) {
+				replyIPs = append(replyIPs, ip.String())
+			}
+		}
+		keys := make([]string, 0, len(replyIPs))
+		for _, ip := range replyIPs {
+			keys = append(keys, net.JoinHostPort(ip, strconv.Itoa(int(dstPort))))
+		}
+		u.addReply(route, keys...)
+		log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp PROXY %s for %s", connAddr, net.JoinHostPort(targetAddr, strconv.Itoa(int(dstPort)))))
+		return route
+	}
+
+	// auto 和 local 都走本地
+	ip := net.ParseIP(dstIP)
+	if ip == nil {
+		log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp lookup %s fail", dstName))
+		return route
+	}
+	route.addr = &net.UDPAddr{IP: ip, Port: int(dstPort)}
+	route.target = "local"
+	t.registerCounter(dstName, dstIP, dstPort)
+	u.addReply(route, route.addr.String())
+	if dstName == "" {
+		log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp direct to %s", route.addr.String()))
+	} else {
+		log.Println(trace.ID(u.req.ID), fmt.Sprintf("udp direct to %s for %s", route.addr.String(), dstName))
+	}
+	return route
+}
+
+func (u *socks5UDP) addReply(route *udpRoute, keys ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	route.replyKeys = keys
+	for _, key := range keys {
+		u.replies[key] = route
+	}
+}
+
+// removeRoute 删除路由和它的回包地址
+func (u *socks5UDP) removeRoute(key string, route *udpRoute) {
+	delete(u.routes, key)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, key := range route.replyKeys {
+		if u.replies[key] == route {
+			delete(u.replies, key)
+		}
+	}
+}
+
+// expireRoutes 新建路由前清理空闲超时的路由，数量仍超出时淘汰最久未用的
+// 避免一个客户端发往大量目标地址时内存一直增长
+func (u *socks5UDP) expireRoutes() {
+	now := time.Now()
+	if now.Sub(u.lastSweep) >= u.timeout {
+		u.lastSweep = now
+		for k, v := range u.routes {
+			if now.Sub(v.lastUsed) >= u.timeout {
+				u.removeRoute(k, v)
+			}
+		}
+	}
+	for len(u.routes) >= maxUDPRoutes {
+		var oldestKey string
+		var oldest *udpRoute
+		for k, v := range u.routes {
+			if oldest == nil || v.lastUsed.Before(oldest.lastUsed) {
+				oldestKey, oldest = k, v
+			}
+		}
+		u.removeRoute(oldestKey, oldest)
+	}
+}
+
+// replyRoute 回包地址对应的路由，没有时返回nil
+func (u *socks5UDP) replyRoute(key string) *udpRoute {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.replies[key]
+}
+
+// sendClient 回包给客户端，route为nil时不统计流量
+func (u *socks5UDP) sendClient(route *udpRoute, p []byte, dataLen int) {
+	u.mu.Lock()
+	client := u.client
+	u.mu.Unlock()
+	if client == nil {
+		return
+	}
+	if _, err := u.relay.WriteToUDP(p, client); err != nil {
+		if config.DebugLevel >= config.LevelLong {
+			log.Println(trace.ID(u.req.ID), "udp write client err", err.Error())
+		}
+		return
+	}
+	if route != nil {
+		route.tunnel.outbountCounter.Add(int64(dataLen))
+	}
+}
+
+// readLocal 读取本地直连的回包，加上udp头部发给客户端，不是发往过的地址发来的丢弃
+func (u *socks5UDP) readLocal() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, from, err := u.local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		route := u.replyRoute(from.String())
+		if route == nil {
+			if config.DebugLevel >= config.LevelDebug {
+				log.Println(trace.ID(u.req.ID), "udp drop reply from", from.String())
+			}
+			continue
+		}
+		u.sendClient(route, append(udpHeader(from.IP.String(), uint16(from.Port)), buf[:n]...), n)
+	}
+}
+
+// readUpstream 读取上游的回包，已带udp头部直接发给客户端，连接的udp只收上游发来的
+func (u *socks5UDP) readUpstream(upstream *udpUpstream) {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, err := upstream.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		name, ip, port, data, err := parseUDPHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+		u.sendClient(u.replyRoute(net.JoinHostPort(name+ip, strconv.Itoa(int(port)))), buf[:n], len(data))
+	}
+}
+
+// getUpstream 取上游socks5的UDP关联，没有则新建
+func (u *socks5UDP) getUpstream(network, connAddr string, user *url.Userinfo) (*udpUpstream, error) {
+	if upstream, ok := u.upstreams[connAddr]; ok {
+		return upstream, nil
+	}
+	upstream, err := dialSocks5UDP(network, connAddr, user)
+	if err != nil {
+		return nil, err
+	}
+	u.upstreams[connAddr] = upstream
+	go func() {
+		// 上游控制连接断开时关联失效
+		io.Copy(io.Discard, upstream.ctrl)
+		upstream.conn.Close()
+	}()
+	go u.readUpstream(upstream)
+	return upstream, nil
+}
+
+func (u *socks5UDP) removeUpstream(upstream *udpUpstream) {
+	for k, v := range u.upstreams {
+		if v == upstream {
+			delete(u.upstreams, k)
+		}
+	}
+	for k, v := range u.routes {
+		if v.upstream == upstream {
+			u.removeRoute(k, v)
+		}
+	}
+	upstream.ctrl.Close()
+	upstream.conn.Close()
+}
+
+func (u *socks5UDP) closeUpstreams() {
+	for _, upstream := range u.upstreams {
+		upstream.ctrl.Close()
+		upstream.conn.Close()
+	}
+}
+
+// dialSocks5UDP 向上游socks5发起UDP ASSOCIATE
+func dialSocks5UDP(network, connAddr string, user *url.Userinfo) (*udpUpstream, error) {
+	ctrl, err := net.DialTimeout(network, connAddr, time.Duration(5)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(time.Duration(5) * time.Second))
+	upstream, err := socks5UDPHandshake(ctrl, user)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+	return upstream, nil
+}
+
+func socks5UDPHandshake(ctrl net.Conn, user *url.Userinfo) (*udpUpstream, error) {
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthUserPass
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 0x01, method}); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, resp[:2]); err != nil {
+		return nil, err
+	}
+	if resp[0] != socks5Version || resp[1] != method {
+		return nil, errors.New("upstream socks5 auth method is not supported")
+	}
+	if method == socks5AuthUserPass {
+		name := user.Username()
+		pass, _ := user.Password()
+		auth := append([]byte{socks5UserPassVersion, byte(len(name))}, name...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := ctrl.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(ctrl, resp[:2]); err != nil {
+			return nil, err
+		}
+		if resp[1] != socks5UserPassSuccess {
+			return nil, errors.New("upstream socks5 auth fail")
+		}
+	}
+	req := append([]byte{socks5Version, socks5CmdUDP, 0x00}, socks5Addr("0.0.0.0", 0)...)
+	if _, err := ctrl.Write(req); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(ctrl, resp); err != nil {
+		return nil, err
+	}
+	if resp[1] != 0x00 {
+		return nil, fmt.Errorf("upstream socks5 udp associate fail, reply %d", resp[1])
+	}
+	_, bndIP, bndPort, err := readSocks5Addr(ctrl)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(bndIP)
+	if ip == nil || ip.IsUnspecified() {
+		ip = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: int(bndPort)})
+	if err != nil {
+		return nil, err
+	}
+	return &udpUpstream{ctrl: ctrl, conn: conn}, nil
+}
@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+func TestUDPExpireRoutes(t *testing.T) {
+	u := &socks5UDP{
+		timeout: time.Minute,
+		routes:  make(map[string]*udpRoute),
+		replies: make(map[string]*udpRoute),
+	}
+	now := time.Now()
+	idle := &udpRoute{lastUsed: now.Add(-2 * time.Minute)}
+	u.routes["idle"] = idle
+	u.addReply(idle, "idle:53")
+	for i := 0; i < maxUDPRoutes-1; i++ {
+		u.routes[strconv.Itoa(i)] = &udpRoute{lastUsed: now.Add(time.Duration(i) * time.Millisecond)}
+	}
+
+	// 空闲超时的先清理，腾出位置后不再淘汰
+	u.expireRoutes()
+	if _, ok := u.routes["idle"]; ok {
+		t.Fatal("idle route not expired")
+	}
+	if _, ok := u.replies["idle:53"]; ok {
+		t.Fatal("reply of idle route not removed")
+	}
+	if len(u.routes) != maxUDPRoutes-1 {
+		t.Fatalf("routes = %d, want %d", len(u.routes), maxUDPRoutes-1)
+	}
+
+	// 满了淘汰最久未用的
+	u.routes["new"] = &udpRoute{lastUsed: now.Add(time.Second)}
+	u.expireRoutes()
+	if len(u.routes) != maxUDPRoutes-1 {
+		t.Fatalf("routes = %d, want %d", len(u.routes), maxUDPRoutes-1)
+	}
+	if _, ok := u.routes["0"]; ok {
+		t.Fatal("oldest route not evicted")
+	}
+}
+
+func TestUDPHeader(t *testing.T) {
+	tests := []struct {
+		host string
+		port uint16
+	}{
+		{"1.2.3.4", 53},
+		{"2001:db8::1", 443},
+		{"www.example.com", 8080},
+	}
+	for _, tt := range tests {
+		p := append(udpHeader(tt.host, tt.port), "data"...)
+		name, ip, port, data, err := parseUDPHeader(p)
+		if err != nil || name+ip != tt.host || port != tt.port || string(data) != "data" {
+			t.Fatalf("%s: name %q ip %q port %d data %q err %v", tt.host, name, ip, port, data, err)
+		}
+	}
+
+	// 分片的和不完整的丢弃
+	p := udpHeader("1.2.3.4", 53)
+	p[2] = 0x01
+	if _, _, _, _, err := parseUDPHeader(append(p, "data"...)); err != errUDPFragment {
+		t.Fatalf("fragment err = %v", err)
+	}
+	for _, p := range [][]byte{{0, 0, 0}, {0, 0, 0, socks5AtypIPv4, 1, 2}, {0, 0, 0, 0x09, 1, 2, 3, 4, 0, 53}} {
+		if _, _, _, _, err := parseUDPHeader(p); err == nil {
+			t.Fatalf("bad header %v accepted", p)
+		}
+	}
+}
+
+// udpEcho 原样返回收到的包
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxUDPPacket)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn
+}
+
+func TestUDPRelayRoundTrip(t *testing.T) {
+	// 控制连接，客户端udp只能从同一个IP发出
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	u := newSocks5UDP(newRequest(context.Background(), conn, &conf.Router{}))
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	u.relay, u.local = listen(), listen()
+	go u.readLocal()
+	go u.readClient()
+
+	echo := udpEcho(t).LocalAddr().(*net.UDPAddr)
+	client := listen()
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	relay := u.relay.LocalAddr().(*net.UDPAddr)
+
+	// 分片的包不转发
+	frag := append(udpHeader(echo.IP.String(), uint16(echo.Port)), "frag"...)
+	frag[2] = 0x01
+	client.WriteToUDP(frag, relay)
+
+	// 没有发往过的地址发来的包不转给客户端
+	stray := listen()
+	client.WriteToUDP(append(udpHeader(echo.IP.String(), uint16(echo.Port)), "ping"...), relay)
+	buf := make([]byte, maxUDPPacket)
+	n, _, err := client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, ip, port, data, err := parseUDPHeader(buf[:n])
+	if err != nil || name != "" || ip != echo.IP.String() || int(port) != echo.Port || string(data) != "ping" {
+		t.Fatalf("reply ip %q port %d data %q err %v", ip, port, data, err)
+	}
+	stray.WriteToUDP([]byte("stray"), u.local.LocalAddr().(*net.UDPAddr))
+	client.WriteToUDP(append(udpHeader(echo.IP.String(), uint16(echo.Port)), "pong"...), relay)
+	n, _, err = client.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, data, _ = parseUDPHeader(buf[:n]); string(data) != "pong" {
+		t.Fatalf("got %q, want pong", data)
+	}
+}
@@ -1,10 +1,13 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"time"
 
+	"github.com/keminar/anyproxy/config"
 	"github.com/keminar/anyproxy/proto/tcp"
 	"github.com/keminar/anyproxy/utils/trace"
 )
@@ -40,7 +43,13 @@ func (that *tcpStream) response() error {
 	tunnel := newTunnel(that.req)
 	var err error
 	var newTCPConn *net.TCPConn
-	that.req.DstIP, that.req.DstPort, newTCPConn, err = GetOriginalDstAddr(that.req.conn)
+	// 要在取原始地址前识别，取原始地址时旧连接会被关闭
+	that.sniffName()
+	tcpConn, ok := that.req.conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("conn is not a *net.TCPConn")
+	}
+	that.req.DstIP, that.req.DstPort, newTCPConn, err = GetOriginalDstAddr(tcpConn)
 	if err != nil {
 		log.Println(trace.ID(that.req.ID), "GetOriginalDstAddr err", err.Error())
 		return err
@@ -48,7 +57,7 @@ func (that *tcpStream) response() error {
 	defer newTCPConn.Close()
 
 	that.showIP("TCP")
-	err = tunnel.handshake(protoTCP, "", that.req.DstIP, uint16(that.req.DstPort))
+	err = tunnel.handshake(protoTCP, that.req.DstName, that.req.DstIP, uint16(that.req.DstPort))
 	if err != nil {
 		log.Println(trace.ID(that.req.ID), "dail err", err.Error())
 		return err
@@ -65,6 +74,21 @@ func (that *tcpStream) response() error {
 	return nil
 }
 
+// sniffName 从首包识别域名(HTTP Host或TLS SNI)，让hosts规则可以按域名生效
+func (that *tcpStream) sniffName() {
+	// 客户端只发了部分ClientHello时不能一直等
+	that.req.conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer that.req.conn.SetReadDeadline(time.Time{})
+	that.req.DstName = sniffHost(that.req.reader)
+	if that.req.DstName != "" && config.DebugLevel >= config.LevelDebug {
+		log.Println(trace.ID(that.req.ID), "sniff host", that.req.DstName)
+	}
+}
+
 func (that *tcpStream) showIP(method string) {
+	if that.req.DstName != "" {
+		log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d for %s", method, that.req.conn.RemoteAddr().String(), that.req.DstIP, that.req.DstPort, that.req.DstName))
+		return
+	}
 	log.Println(trace.ID(that.req.ID), fmt.Sprintf("%s %s -> %s:%d", method, that.req.conn.RemoteAddr().String(), that.req.DstIP, that.req.DstPort))
 }
@@ -63,7 +63,7 @@ func GetOriginalDstAddr(tcpConn *net.TCPConn) (dstIP string, dstPort uint16, new
 
 		ipArr := strings.Split(srcipport, ":")
 		// 来源和目标地址是同一个ip，且目标端口和本服务是同一个端口
-		if ipArr[0] == dstIP && dstPort == config.ListenPort {
+		if ipArr[0] == dstIP && dstPort == config.ListenPort() {
 			err = fmt.Errorf("may be loop call: %s=>%s:%d", srcipport, dstIP, dstPort)
 		}
 		return
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"log"
 
-	"github.com/keminar/anyproxy/utils/conf"
 	"github.com/keminar/anyproxy/utils/trace"
 )
 
@@ -32,8 +31,8 @@ func (that *tcpCopy) response() error {
 		return errors.New(ip + " is not allowed")
 	}
 	var err error
-	that.req.DstIP = conf.RouterConfig.TcpCopy.IP
-	that.req.DstPort = conf.RouterConfig.TcpCopy.Port
+	that.req.DstIP = that.req.cnf.TcpCopy.IP
+	that.req.DstPort = that.req.cnf.TcpCopy.Port
 
 	network, connAddr := tunnel.buildAddress("", that.req.DstIP, that.req.DstPort, true)
 	if connAddr == "" {
@@ -0,0 +1,128 @@
+package proto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+// tlsCache 按配置缓存TLS设置，配置热加载后重新读取证书
+type tlsCache struct {
+	mu     sync.Mutex
+	conf   conf.TunnelTLS
+	config *tls.Config
+}
+
+var (
+	clientTLS tlsCache
+	serverTLS tlsCache
+)
+
+// get 配置未变化时用缓存
+func (c *tlsCache) get(cnf conf.TunnelTLS, build func(conf.TunnelTLS) (*tls.Config, error)) (*tls.Config, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.config != nil && c.conf == cnf {
+		return c.config, nil
+	}
+	config, err := build(cnf)
+	if err != nil {
+		return nil, err
+	}
+	c.conf, c.config = cnf, config
+	return config, nil
+}
+
+// tunnelClientTLS 客户端连接tunnels的TLS配置, serverName为空时用代理地址
+func tunnelClientTLS(cnf *conf.Router, server string) (*tls.Config, error) {
+	config, err := clientTLS.get(cnf.Tunnel.TLS, buildClientTLS)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName != "" {
+		return config, nil
+	}
+	config = config.Clone()
+	config.ServerName = server
+	return config, nil
+}
+
+// buildClientTLS 固定CA校验tunnel证书，有证书时用于双向认证
+func buildClientTLS(cnf conf.TunnelTLS) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cnf.ServerName,
+	}
+	if cnf.CA != "" {
+		pool, err := loadCertPool(cnf.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if cnf.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.RelPath(cnf.Cert), conf.RelPath(cnf.Key))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tunnelServerTLS tunnel模式的TLS配置，未配置证书时返回nil
+func tunnelServerTLS(cnf *conf.Router) (*tls.Config, error) {
+	if cnf.Tunnel.TLS.Cert == "" {
+		return nil, nil
+	}
+	return serverTLS.get(cnf.Tunnel.TLS, buildServerTLS)
+}
+
+// buildServerTLS 配置了clientCA时要求并校验客户端证书
+func buildServerTLS(cnf conf.TunnelTLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.RelPath(cnf.Cert), conf.RelPath(cnf.Key))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cnf.ClientCA != "" {
+		pool, err := loadCertPool(cnf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool 读取PEM格式的CA证书
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(conf.RelPath(file))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// CheckTunnelTLS 启动时检查tunnel模式的证书配置
+func CheckTunnelTLS() (enabled bool, err error) {
+	cnf := conf.Current()
+	if cnf == nil {
+		return false, errors.New("router config is nil")
+	}
+	config, err := tunnelServerTLS(cnf)
+	return config != nil, err
+}
@@ -2,20 +2,23 @@ package proto
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/keminar/anyproxy/proto/stats"
 
 	"github.com/keminar/anyproxy/config"
-	"github.com/keminar/anyproxy/crypto"
 	"github.com/keminar/anyproxy/proto/tcp"
 	"github.com/keminar/anyproxy/utils/cache"
 	"github.com/keminar/anyproxy/utils/conf"
@@ -34,6 +37,7 @@ const (
 const protoTCP = "tcp"
 const protoHTTP = "http"
 const protoHTTPS = "https"
+const protoUDP = "udp"
 
 // 上行统计
 var inbound *stats.Manager
@@ -55,10 +59,21 @@ func init() {
 	}()
 }
 
+// denyError 被配置规则禁止访问，和网络错误区分开以便给客户端不同的应答
+type denyError string
+
+func (e denyError) Error() string { return string(e) }
+
+// duplexConn 可单独关闭写的连接，*net.TCPConn 和 *tls.Conn 都满足
+type duplexConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
 // 转发实体
 type tunnel struct {
 	req      *Request
-	conn     *net.TCPConn // 后端服务
+	conn     duplexConn // 后端服务
 	curState int
 
 	inboundIP string // 来源IP
@@ -72,6 +87,17 @@ type tunnel struct {
 	clientUnRead int
 
 	buf []byte
+
+	proxyAuth string // 直连http代理时请求头部要带的认证
+
+	group  *upstreamGroup // 选用的代理组，连接失败时重试
+	member *member        // 选用的代理组成员，用于统计连接数和熔断
+
+	rule     int    // 命中规则序号，-1为未命中，错误页显示
+	ruleName string // 命中规则的name
+	via      string // 最后连接的代理，管理接口显示
+
+	stat *connStat // 管理接口显示的连接信息
 }
 
 // newTunnel 实例
@@ -132,8 +158,10 @@ func (s *tunnel) copyBuffer(dst io.Writer, src *tcp.Reader, srcname string) (wri
 				written += int64(nw)
 				if srcname == "request" {
 					s.inbountCounter.Add(int64(nw))
+					atomic.AddInt64(&s.stat.up, int64(nw))
 				} else {
 					s.outbountCounter.Add(int64(nw))
+					atomic.AddInt64(&s.stat.down, int64(nw))
 				}
 			}
 			if ew != nil {
@@ -162,7 +190,7 @@ func (s *tunnel) copyBuffer(dst io.Writer, src *tcp.Reader, srcname string) (wri
 						//         等服务时,当请求的地址返回足够长的内容时会触发卡住问题。
 						//         流程如 curl -> anyproxy(server) -> ws -> anyproxy(windows) -> charles
 						//         用Close()可以解决卡住，不过客户端会收到use of closed network connection的错误提醒
-						dst.(*net.TCPConn).Close()
+						dst.(net.Conn).Close()
 					}
 				}
 			}
@@ -185,6 +213,12 @@ func (s *tunnel) transfer(clientUnRead int) {
 	}
 	s.curState = stateActive
 	s.clientUnRead = clientUnRead
+	if s.member != nil {
+		s.member.acquire()
+		defer s.member.release()
+	}
+	s.stat = registerConn(s)
+	defer unregisterConn(s.req.ID, s.stat)
 	done := make(chan struct{})
 
 	//发送请求
@@ -251,12 +285,30 @@ func (s *tunnel) dail(network, connAddr string, second int64) error {
 	return nil
 }
 
+// dailIPs 错开连接解析出的多个地址，先连通的生效
+func (s *tunnel) dailIPs(ips []net.IP, port uint16, second int64) error {
+	if config.DebugLevel >= config.LevelLong {
+		log.Printf("%s create new connection to server %v port %d\n", trace.ID(s.req.ID), ips, port)
+	}
+
+	connTimeout := time.Duration(5) * time.Second
+	if second > 0 {
+		connTimeout = time.Duration(second) * time.Second
+	}
+	conn, err := dialIPs(s.req.ID, getBreakerConf(s.req.cnf), ips, port, connTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn.(*net.TCPConn)
+	return nil
+}
+
 // 注册计数器, 日志地址优先使用域名
 func (s *tunnel) registerCounter(dstName, dstIP string, dstPort uint16) {
 	// 日志地址优先使用域名
 	var logAddr string
 	if dstName != "" {
-		logAddr = fmt.Sprintf("%s:%d", dstName, dstPort)
+		logAddr = net.JoinHostPort(dstName, strconv.Itoa(int(dstPort)))
 	} else {
 		if strings.Contains(dstIP, ":") {
 			logAddr = fmt.Sprintf("[%s]:%d", dstIP, dstPort)
@@ -264,8 +316,13 @@ func (s *tunnel) registerCounter(dstName, dstIP string, dstPort uint16) {
 			logAddr = fmt.Sprintf("%s:%d", dstIP, dstPort)
 		}
 	}
-	uplink := fmt.Sprintf("inbound>>>%s>>>%s>>>uplink", s.inboundIP, logAddr)
-	downlink := fmt.Sprintf("inbound>>>%s>>>%s>>>downlink", s.inboundIP, logAddr)
+	// 有登录用户时按用户统计
+	inboundName := s.inboundIP
+	if s.req.User != "" {
+		inboundName = s.req.User + "@" + s.inboundIP
+	}
+	uplink := fmt.Sprintf("inbound>>>%s>>>%s>>>uplink", inboundName, logAddr)
+	downlink := fmt.Sprintf("inbound>>>%s>>>%s>>>downlink", inboundName, logAddr)
 	s.inbountCounter = inbound.RegisterCounter(uplink)
 	s.outbountCounter = outbound.RegisterCounter(downlink)
 }
@@ -281,7 +338,7 @@ func (s *tunnel) buildAddress(dstName, dstIP string, dstPort uint16, addCounter
 			connAddr = fmt.Sprintf("%s:%d", dstIP, dstPort)
 		}
 	} else if dstName != "" {
-		connAddr = fmt.Sprintf("%s:%d", dstName, dstPort)
+		connAddr = net.JoinHostPort(dstName, strconv.Itoa(int(dstPort)))
 	}
 
 	if addCounter && connAddr != "" {
@@ -290,45 +347,22 @@ func (s *tunnel) buildAddress(dstName, dstIP string, dstPort uint16, addCounter
 	return
 }
 
-// DNS解析
-func (s *tunnel) lookup(dstName, dstIP string) (string, cache.DialState) {
-	state := cache.StateNone
-	if dstName != "" {
-		dstIP, state = cache.ResolveLookup.Lookup(s.req.ID, dstName)
-		if dstIP == "" {
-			s1 := time.Now()
-			upIPs, _ := net.LookupIP(dstName)
-			if time.Since(s1).Seconds() > 1 && config.DebugLevel >= config.LevelLong {
-				log.Println(trace.ID(s.req.ID), "dns look up costtime", time.Since(s1).Seconds())
-			}
-			if len(upIPs) > 0 {
-				dstIP = upIPs[0].String()
-				cache.ResolveLookup.Store(dstName, dstIP, cache.StateNew, time.Duration(10)*time.Minute)
-				return dstIP, cache.StateNew
-			}
-		}
+// DNS解析, confDNS为local或dns.servers的名称, 结果按prefer排序
+func (s *tunnel) lookup(dstName, confDNS, prefer string) []net.IP {
+	s1 := time.Now()
+	upIPs, err := currentResolvers(s.req.cnf).lookupIP(context.Background(), s.req.ID, confDNS, dstName)
+	if err != nil && config.DebugLevel >= config.LevelLong {
+		log.Println(trace.ID(s.req.ID), "dns look up", dstName, confDNS, err)
 	}
-	return dstIP, state
+	if time.Since(s1).Seconds() > 1 && config.DebugLevel >= config.LevelLong {
+		log.Println(trace.ID(s.req.ID), "dns look up costtime", time.Since(s1).Seconds())
+	}
+	return sortIPs(upIPs, prefer)
 }
 
-// 查询配置
-func findHost(dstName, dstIP string) conf.Host {
-	for _, h := range conf.RouterConfig.Hosts {
-		confMatch := getString(h.Match, conf.RouterConfig.Default.Match, "equal")
-		switch confMatch {
-		case "equal":
-			if h.Name == dstName || h.Name == dstIP {
-				return h
-			}
-		case "contain":
-			if strings.Contains(dstName, h.Name) || strings.Contains(dstIP, h.Name) {
-				return h
-			}
-		default:
-			//todo
-		}
-	}
-	return conf.Host{}
+// 查询配置, user为空时只匹配不限用户的配置, srcIP为客户端ip, 未命中时rule为-1
+func findHost(cnf *conf.Router, dstName, dstIP string, dstPort uint16, srcIP, user string) (host conf.Host, rule int) {
+	return currentIndex(cnf).lookup(dstName, dstIP, dstPort, srcIP, user)
 }
 
 // 取值，如为空取默认
@@ -342,89 +376,207 @@ func getString(val string, def string, def2 string) string {
 	return val
 }
 
-// handshake 和server握手
-func (s *tunnel) handshake(proto string, dstName, dstIP string, dstPort uint16) (err error) {
-	var state cache.DialState
-	// 先取下配置，再决定要不要走本地dns解析，否则未解析域名DNS解析再超时卡半天，又不会被缓存
-	host := findHost(dstName, dstIP)
+// getRoute 查询配置并检查访问权限，返回访问策略和DNS策略
+func (s *tunnel) getRoute(proto string, dstName, dstIP string, dstPort uint16) (host conf.Host, rule int, confTarget string, confDNS string, err error) {
+	host, rule = findHost(s.req.cnf, dstName, dstIP, dstPort, s.inboundIP, s.req.User)
 	if ip, ok := s.isAllowed(host.AllowIP); !ok {
-		err = fmt.Errorf("%s is not allowed", ip)
-		return err
+		err = denyError(fmt.Sprintf("%s is not allowed", ip))
+		return
+	}
+	if user, ok := s.isAllowedUser(host.AllowUser); !ok {
+		err = denyError(fmt.Sprintf("user %s is not allowed", strconv.Quote(user)))
+		return
 	}
-	var confTarget string
-	if proto == protoTCP {
-		confTarget = getString(host.Target, conf.RouterConfig.Default.TCPTarget, "auto")
+	if proto == protoTCP || proto == protoUDP {
+		confTarget = getString(host.Target, s.req.cnf.Default.TCPTarget, "auto")
 	} else {
-		confTarget = getString(host.Target, conf.RouterConfig.Default.Target, "auto")
+		confTarget = getString(host.Target, s.req.cnf.Default.Target, "auto")
+	}
+	confDNS = getString(host.DNS, s.req.cnf.Default.DNS, "local")
+	return
+}
+
+// upstream 上游代理服务器
+type upstream struct {
+	scheme string
+	server string
+	port   uint16
+	user   *url.Userinfo // 认证信息，为nil不认证
+	token  string        // tunnel协议的通信密钥，为空用全局配置
+}
+
+// addr 代理服务器地址
+func (u upstream) addr() string {
+	return net.JoinHostPort(u.server, strconv.Itoa(int(u.port)))
+}
+
+// proxyAuth http代理的Proxy-Authorization值
+func (u upstream) proxyAuth() string {
+	if u.user == nil {
+		return ""
+	}
+	pass, _ := u.user.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.user.Username()+":"+pass))
+}
+
+// tunnelToken tunnel协议的通信密钥
+func (u upstream) tunnelToken(cnf *conf.Router) string {
+	if u.token != "" {
+		return u.token
+	}
+	return getToken(cnf)
+}
+
+// getProxy 选择代理服务器，自定义代理可用时访问策略改为remote, dst为目标地址，按目标哈希时使用
+func (s *tunnel) getProxy(host conf.Host, confTarget, dst string) (up upstream, target string, err error) {
+	spec := config.Proxy()
+	up = upstream{scheme: spec.Scheme, server: spec.Server, port: spec.Port, user: spec.User, token: spec.Token}
+	target = confTarget
+	// 按域名配置的通信密钥优先
+	defer func() {
+		if host.Token != "" {
+			up.token = host.Token
+		}
+	}()
+	//如果有自定义代理或代理组，则走自定义，可用状态由后台检查
+	g := findGroup(s.req.cnf, host)
+	if g == nil {
+		return
+	}
+	// 只查看不占用熔断的试探机会，route explain 和之后被禁止的请求都不会连接
+	if m := g.candidate(dst, getBreakerConf(s.req.cnf), nil); m != nil {
+		up, s.group, s.member = m.up, g, m
+		if target != "remote" { //如果有定制代理，就不能用local 和 auto
+			target = "remote"
+		}
+		return
+	}
+	// 如果自定义代理都不可用，confTarget走原来逻辑，deny时按上游失败应答而不是规则禁止
+	log.Println(trace.ID(s.req.ID), "host.proxy err no healthy proxy in", g.name)
+	if g.fallback == "last" { //没通的代理，走本地
+		up.server = ""
+	} else if g.fallback == "deny" {
+		err = fmt.Errorf("all proxy dail fail %s", g.name)
+	}
+	return
+}
+
+// routeInfo 路由决策结果，handshake按此连接，route explain按此输出
+type routeInfo struct {
+	host    conf.Host
+	rule    int    // 命中规则序号，-1为未命中
+	target  string // 访问策略，自定义代理可用时为remote
+	dns     string // DNS策略
+	dstName string
+	dstIP   string   // 规则指定或本地解析的第一个ip
+	dstIPs  []net.IP // 本地解析的所有ip，按prefer排序
+	dstPort uint16   // 换端口后的目标端口
+	state   cache.DialState
+	up      upstream
+}
+
+// route 按配置得出访问方式，只做DNS解析和代理可用检查，不建立连接
+func (s *tunnel) route(proto string, dstName, dstIP string, dstPort uint16) (r routeInfo, err error) {
+	r = routeInfo{dstName: dstName, dstIP: dstIP, dstPort: dstPort}
+	// 先取下配置，再决定要不要走本地dns解析，否则未解析域名DNS解析再超时卡半天，又不会被缓存
+	r.host, r.rule, r.target, r.dns, err = s.getRoute(proto, dstName, dstIP, dstPort)
+	if err != nil {
+		return
 	}
-	confDNS := getString(host.DNS, conf.RouterConfig.Default.DNS, "local")
 
 	// tcp 请求，如果是解析的IP被禁（代理端也无法telnet），不知道域名又无法使用远程dns解析，只能手动换ip
 	// 如golang.org 解析为180.97.235.30 不通，配置改为 216.239.37.1就行
-	if host.IP != "" {
-		dstIP = host.IP
-	} else if dstName != "" && confDNS != "remote" {
+	if r.host.IP != "" {
+		r.dstIP = r.host.IP
+	} else if dstName != "" && r.dns != "remote" {
 		// http请求的dns解析
-		dstIP, state = s.lookup(dstName, dstIP)
+		r.dstIP = ""
+		if r.dstIPs = s.lookup(dstName, r.dns, r.host.Prefer); len(r.dstIPs) > 0 {
+			r.dstIP = r.dstIPs[0].String()
+		}
+		// 域名没有命中规则时，用解析出的ip再匹配一次ip和cidr规则
+		if r.rule < 0 && r.dstIP != "" {
+			r.host, r.rule, r.target, r.dns, err = s.getRoute(proto, dstName, r.dstIP, dstPort)
+			if err != nil {
+				return
+			}
+			if r.host.IP != "" {
+				r.dstIP, r.dstIPs = r.host.IP, nil
+			} else if r.host.Prefer != "" {
+				r.dstIPs = sortIPs(r.dstIPs, r.host.Prefer)
+				r.dstIP = r.dstIPs[0].String()
+			}
+		}
+	}
+	// 失败记录按ip地址，所有地址都失败过时auto直接走远程
+	if len(r.dstIPs) == 0 && r.dstIP != "" {
+		if ip := net.ParseIP(r.dstIP); ip != nil {
+			r.dstIPs = []net.IP{ip}
+		}
+	}
+	r.state = cache.StateNone
+	if len(r.dstIPs) > 0 {
+		r.state = cache.StateNew
+		if allFailed(getBreakerConf(s.req.cnf), r.dstIPs) {
+			r.state = cache.StateFail
+		}
 	}
 
 	// 检查是否要换端口
-	for _, p := range host.Port {
+	for _, p := range r.host.Port {
 		if p.From == dstPort {
-			dstPort = p.To
+			r.dstPort = p.To
 			break
 		}
 	}
 
-	if confTarget == "deny" {
-		err = fmt.Errorf("deny visit %s (%s)", dstName, dstIP)
+	if r.target == "deny" {
+		err = denyError(fmt.Sprintf("deny visit %s (%s)", dstName, r.dstIP))
 		return
 	}
-	proxyScheme := config.ProxyScheme
-	proxyServer := config.ProxyServer
-	proxyPort := config.ProxyPort
-	if host.Proxy != "" { //如果有自定义代理，则走自定义
-		suffixLen := 5
-		// 如果单域名代理配置以" last"或" deny"结尾，忽略全局的代理,并做相应的动作
-		opIdx := len(host.Proxy) - suffixLen
-		opName := ""
-		if len(host.Proxy) >= suffixLen && host.Proxy[opIdx:opIdx+1] == " " {
-			opName = host.Proxy[opIdx+1:]
-			host.Proxy = host.Proxy[:opIdx]
-		}
-
-		// 支持多代理以逗号分隔，依次找到能用的
-		for _, hostProxy := range strings.Split(host.Proxy, ",") {
-			hostProxy = strings.TrimSpace(hostProxy)
-			proxyScheme2, proxyServer2, proxyPort2, err := getProxyServer(hostProxy)
-			if err != nil {
-				// 如果自定义代理不可用，confTarget走原来逻辑
-				log.Println(trace.ID(s.req.ID), "host.proxy err", err)
-			} else {
-				proxyScheme = proxyScheme2
-				proxyServer = proxyServer2
-				proxyPort = proxyPort2
-				if confTarget != "remote" { //如果有定制代理，就不能用local 和 auto
-					confTarget = "remote"
-				}
-				opName = ""
-				break
-			}
-		}
-		if opName == "last" { //没通的代理，走本地
-			proxyServer = ""
-		} else if opName == "deny" {
-			err = fmt.Errorf("all proxy dail fail %s", host.Proxy)
-			return
+	dst := dstName
+	if dst == "" {
+		dst = r.dstIP
+	}
+	r.up, r.target, err = s.getProxy(r.host, r.target, dst)
+	return
+}
+
+// proxyTarget 经代理访问时的目标地址，远程dns时用域名
+func (s *tunnel) proxyTarget(dstName, dstIP string, dstPort uint16, confDNS string) (targetNet, targetAddr string) {
+	if confDNS == "remote" {
+		if dstName == "" {
+			dstName = dstIP
 		}
+		return s.buildAddress(dstName, "", dstPort, false)
 	}
-	if proxyServer != "" && proxyPort > 0 && confTarget != "local" {
+	return s.buildAddress("", dstIP, dstPort, false)
+}
+
+// handshake 和server握手
+func (s *tunnel) handshake(proto string, dstName, dstIP string, dstPort uint16) (err error) {
+	r, err := s.route(proto, dstName, dstIP, dstPort)
+	s.rule, s.ruleName = r.rule, r.host.Name
+	if err != nil {
+		return
+	}
+	dstIP, dstPort = r.dstIP, r.dstPort
+	confTarget, confDNS, state, up := r.target, r.dns, r.state, r.up
+	if up.server != "" && up.port > 0 && confTarget != "local" {
 		if confTarget == "auto" {
 			if state != cache.StateFail {
 				//local dial成功则返回，走本地网络
 				//auto 只能优化ip ping 不通的情况，能dail通访问不了的需要手动remote
+				//解析出多个ip时跳过失败过的地址，所有地址都失败才走远程
 				network, connAddr := s.buildAddress(dstName, dstIP, dstPort, true)
-				if connAddr != "" {
+				if ips := usableIPs(getBreakerConf(s.req.cnf), r.dstIPs, true); len(ips) > 0 {
+					err = s.dailIPs(ips, dstPort, 1)
+					if err == nil {
+						log.Println(trace.ID(s.req.ID), fmt.Sprintf("auto to %s", s.conn.RemoteAddr()))
+						s.curState = stateNew
+						return
+					}
+				} else if connAddr != "" {
 					err = s.dail(network, connAddr, 1)
 					if err == nil {
 						log.Println(trace.ID(s.req.ID), fmt.Sprintf("auto to %s", connAddr))
@@ -432,9 +584,6 @@ func (s *tunnel) handshake(proto string, dstName, dstIP string, dstPort uint16)
 						return
 					}
 				}
-				if dstName != "" && dstIP != "" {
-					cache.ResolveLookup.Store(dstName, dstIP, cache.StateFail, time.Duration(1)*time.Hour)
-				}
 			}
 			//fail的auto 等于用remote访问，但ip在remote访问可能也是不通的，强制用远程dns
 			//如果又想远程，又想用本地dns请配置中单独指定
@@ -442,50 +591,44 @@ func (s *tunnel) handshake(proto string, dstName, dstIP string, dstPort uint16)
 			confDNS = "remote"
 		}
 		// remote 请求
-		var targetAddr string
-		var targetNet string
-		if confDNS == "remote" {
-			if dstName == "" {
-				dstName = dstIP
-			}
-			targetNet, targetAddr = s.buildAddress(dstName, "", dstPort, false)
-		} else {
-			targetNet, targetAddr = s.buildAddress("", dstIP, dstPort, false)
-		}
+		targetNet, targetAddr := s.proxyTarget(dstName, dstIP, dstPort, confDNS)
 		if targetAddr == "" || targetAddr[0] == ':' {
 			err = errors.New("target host is empty")
 			return
 		}
 
-		network, connAddr := s.buildAddress(proxyServer, "", proxyPort, true)
-		switch proxyScheme {
-		case "socks5":
-			log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
-			err = s.socks5(network, connAddr, targetNet, targetAddr)
-		case "tunnel":
-			log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
-			err = s.httpConnect(network, connAddr, targetAddr, true)
-		case "http":
-			if proto == protoHTTP { //可避免转发到charles显示2次域名，且部分电脑请求出错
-				log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s", connAddr))
-				err = s.dail(network, connAddr, 0)
-			} else {
-				log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
-				err = s.httpConnect(network, connAddr, targetAddr, false)
-			}
-		default:
-			err = fmt.Errorf("proxy scheme %s is error", proxyScheme)
+		dst := dstName
+		if dst == "" {
+			dst = dstIP
+		}
+		if up, err = s.claimProxy(r.host, dst, up); err != nil {
+			return
+		}
+		s.buildAddress(up.server, "", up.port, true)
+		err = s.connectVia(proto, up, targetNet, targetAddr)
+		if s.member != nil {
+			err = s.retryVia(proto, r.host, dst, targetNet, targetAddr, err)
+		}
+		if err != nil {
 			return
 		}
 	} else {
 		network, connAddr := s.buildAddress(dstName, dstIP, dstPort, true)
 		if connAddr != "" {
+			if len(r.dstIPs) > 1 {
+				connAddr = fmt.Sprintf("%v:%d", r.dstIPs, dstPort)
+			}
 			if dstName == "" {
 				log.Println(trace.ID(s.req.ID), fmt.Sprintf("direct to %s", connAddr))
 			} else {
 				log.Println(trace.ID(s.req.ID), fmt.Sprintf("direct to %s for %s", connAddr, dstName))
 			}
-			err = s.dail(network, connAddr, 0)
+			if len(r.dstIPs) > 0 {
+				// 失败过的地址排在最后再试
+				err = s.dailIPs(usableIPs(getBreakerConf(s.req.cnf), r.dstIPs, false), dstPort, 0)
+			} else {
+				err = s.dail(network, connAddr, 0)
+			}
 		} else {
 			err = errors.New("dstName && dstIP is empty")
 		}
@@ -497,45 +640,119 @@ func (s *tunnel) handshake(proto string, dstName, dstIP string, dstPort uint16)
 	return
 }
 
-// getProxyServer 解析代理服务器
-func getProxyServer(proxySpec string) (string, string, uint16, error) {
-	if proxySpec == "" {
-		return "", "", 0, errors.New("proxy 长度为空")
-	}
-	proxyScheme := "tunnel"
-	var proxyServer string
-	var proxyPort uint16
-	// 先检查协议
-	tmp := strings.Split(proxySpec, "://")
-	if len(tmp) == 2 {
-		proxyScheme = tmp[0]
-		proxySpec = tmp[1]
-	}
-	// 检查端口，和上面的顺序不能反
-	tmp = strings.Split(proxySpec, ":")
-	if len(tmp) == 2 {
-		portInt, err := strconv.Atoi(tmp[1])
+// connectVia 经代理连接目标地址，http代理访问http请求时直接连代理
+func (s *tunnel) connectVia(proto string, up upstream, targetNet, targetAddr string) (err error) {
+	network, connAddr := s.buildAddress(up.server, "", up.port, false)
+	s.via = up.scheme + "://" + up.addr()
+	switch up.scheme {
+	case "socks5":
+		log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
+		err = s.socks5(network, connAddr, targetNet, targetAddr, up.user)
+	case "tunnel":
+		log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
+		err = s.httpConnect(network, connAddr, targetAddr, up.tunnelToken(s.req.cnf), up.proxyAuth(), nil)
+	case "tunnels":
+		var tlsConf *tls.Config
+		if tlsConf, err = tunnelClientTLS(s.req.cnf, up.server); err != nil {
+			log.Println(trace.ID(s.req.ID), "tls config err", err.Error())
+			break
+		}
+		log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s over tls for %s", connAddr, targetAddr))
+		err = s.httpConnect(network, connAddr, targetAddr, up.tunnelToken(s.req.cnf), up.proxyAuth(), tlsConf)
+	case "http":
+		if proto == protoHTTP { //可避免转发到charles显示2次域名，且部分电脑请求出错
+			log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s", connAddr))
+			err = s.dail(network, connAddr, 0)
+			// 请求头部由http.go发出，需要带上认证
+			s.proxyAuth = up.proxyAuth()
+		} else {
+			log.Println(trace.ID(s.req.ID), fmt.Sprintf("PROXY %s for %s", connAddr, targetAddr))
+			err = s.httpConnect(network, connAddr, targetAddr, "", up.proxyAuth(), nil)
+		}
+	default:
+		err = fmt.Errorf("proxy scheme %s is error", up.scheme)
+	}
+	return
+}
+
+// claimProxy 连接前确定代理并占用半开熔断的试探机会，被其它请求占用时换一个
+// 没有选用代理组时走的是全局代理，全局代理按代理组选用，熔断时不再连接
+func (s *tunnel) claimProxy(host conf.Host, dst string, up upstream) (upstream, error) {
+	bc := getBreakerConf(s.req.cnf)
+	g, exclude := s.group, map[*member]bool{}
+	if s.member == nil {
+		if g = defaultGroup(); g == nil {
+			return up, nil
+		}
+	} else if s.member.brk.ready(bc) {
+		return up, nil
+	} else {
+		exclude[s.member] = true
+	}
+	m := g.pick(dst, bc, exclude)
+	if m == nil {
+		log.Println(trace.ID(s.req.ID), "proxy err breaker open in", g.name)
+		return up, fmt.Errorf("all proxy dail fail %s", g.name)
+	}
+	s.group, s.member = g, m
+	up = m.up
+	if host.Token != "" {
+		up.token = host.Token
+	}
+	return up, nil
+}
+
+// retryVia 记录代理组成员的连接结果，失败时换下一个可用的代理重试，没有其它可用的代理时重试当前代理
+// 握手完成前还没有给客户端发送数据，http和CONNECT请求都可以重试
+// 只有连接失败、断开、超时和5xx记入熔断并重试，代理返回的403等应答直接返回
+func (s *tunnel) retryVia(proto string, host conf.Host, dst, targetNet, targetAddr string, err error) error {
+	bc := getBreakerConf(s.req.cnf)
+	tried := make(map[*member]bool)
+	for i := 0; ; i++ {
 		if err == nil {
-			proxyServer = tmp[0]
-			proxyPort = uint16(portInt)
-			// 检查是否可连通, 内网不好时100毫秒不够，调整到300
-			connTimeout := time.Duration(300) * time.Millisecond
-			conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", proxyServer, proxyPort), connTimeout)
-			if err != nil {
-				return "", "", 0, err
-			}
-			conn.Close()
-			return proxyScheme, proxyServer, proxyPort, nil
+			s.member.brk.success()
+			return nil
 		}
-		return "", "", 0, err
+		// 代理已连上但握手失败时关闭
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		if !upstreamFault(err) {
+			s.member.brk.success()
+			return err
+		}
+		s.member.brk.failure(bc)
+		tried[s.member] = true
+		if i >= s.group.retries {
+			return err
+		}
+		m := s.group.pick(dst, bc, tried)
+		if m == nil && s.member.brk.ready(bc) {
+			m = s.member
+		}
+		if m == nil {
+			return err
+		}
+		log.Println(trace.ID(s.req.ID), "retry", m.name(), "after", err.Error())
+		up := m.up
+		if host.Token != "" {
+			up.token = host.Token
+		}
+		s.member = m
+		err = s.connectVia(proto, up, targetNet, targetAddr)
 	}
-	return "", "", 0, errors.New("proxy 格式不对")
 }
 
 // socket5代理
-func (s *tunnel) socks5(network, connAddr string, targetNet, targetAddr string) (err error) {
+func (s *tunnel) socks5(network, connAddr string, targetNet, targetAddr string, user *url.Userinfo) (err error) {
+	var auth *proxy.Auth
+	if user != nil {
+		auth = &proxy.Auth{User: user.Username()}
+		auth.Password, _ = user.Password()
+	}
 	var dialProxy proxy.Dialer
-	dialProxy, err = proxy.SOCKS5(network, connAddr, nil, proxy.Direct)
+	dialProxy, err = proxy.SOCKS5(network, connAddr, auth, proxy.Direct)
 	if err != nil {
 		log.Println(trace.ID(s.req.ID), "socket5 err", err.Error())
 		return
@@ -551,27 +768,41 @@ func (s *tunnel) socks5(network, connAddr string, targetNet, targetAddr string)
 	return
 }
 
-// http代理
-func (s *tunnel) httpConnect(network, connAddr string, target string, encrypt bool) (err error) {
+// http代理, token不为空时加密目标地址, tlsConf不为空时走TLS
+func (s *tunnel) httpConnect(network, connAddr string, target string, token string, proxyAuth string, tlsConf *tls.Config) (err error) {
 	err = s.dail(network, connAddr, 0)
 	if err != nil {
 		log.Println(trace.ID(s.req.ID), "dail err", err.Error())
 		return
 	}
+	if tlsConf != nil {
+		tlsConn := tls.Client(s.conn, tlsConf)
+		tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err = tlsConn.Handshake(); err != nil {
+			log.Println(trace.ID(s.req.ID), "tls handshake err", err.Error())
+			s.conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		s.conn = tlsConn
+	}
 	var connectString string
-	if encrypt {
-		key := []byte(getToken())
-		var x1 []byte
-		x1, err = crypto.EncryptAES([]byte(target), key)
+	if token != "" {
+		var x1 string
+		x1, err = encryptTarget(target, token)
 		if err != nil {
 			log.Println(trace.ID(s.req.ID), "encrypt err", err.Error())
 			return
 		}
 		// CONNECT实现的加密
-		connectString = fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", base64.StdEncoding.EncodeToString(x1))
+		connectString = fmt.Sprintf("CONNECT %s HTTP/1.1\r\n", x1)
 	} else {
-		connectString = fmt.Sprintf("CONNECT %s HTTP/1.1\r\n\r\n", target)
+		connectString = fmt.Sprintf("CONNECT %s HTTP/1.1\r\n", target)
 	}
+	if proxyAuth != "" {
+		connectString += fmt.Sprintf("Proxy-Authorization: %s\r\n", proxyAuth)
+	}
+	connectString += "\r\n"
 	fmt.Fprintf(s.conn, connectString)
 	var status string
 	status, err = bufio.NewReader(s.conn).ReadString('\n')
@@ -582,14 +813,21 @@ func (s *tunnel) httpConnect(network, connAddr string, target string, encrypt bo
 	// 检查是不是200返回
 	if strings.Contains(status, "200") == false {
 		log.Printf("%s PROXY ERR: Proxy response to CONNECT was: %s.\n", trace.ID(s.req.ID), strconv.Quote(status))
-		err = fmt.Errorf("Proxy response was: %s", strconv.Quote(status))
+		resp := &proxyRespError{status: status}
+		if fields := strings.Fields(status); len(fields) > 1 {
+			resp.code, _ = strconv.Atoi(fields[1])
+		}
+		err = resp
 	}
 	return
 }
 
 // IP限制
 func (s *tunnel) isAllowed(allows []string) (string, bool) {
-	allows = append(allows, conf.RouterConfig.AllowIP...)
+	// 配置快照是共享的，在新切片上合并
+	list := make([]string, 0, len(allows)+len(s.req.cnf.AllowIP))
+	list = append(list, allows...)
+	allows = append(list, s.req.cnf.AllowIP...)
 	if len(allows) == 0 {
 		return "", true
 	}
@@ -603,6 +841,21 @@ func (s *tunnel) isAllowed(allows []string) (string, bool) {
 	return s.inboundIP, false
 }
 
+// 登录用户限制
+func (s *tunnel) isAllowedUser(allows []string) (string, bool) {
+	// 配置快照是共享的，在新切片上合并
+	list := make([]string, 0, len(allows)+len(s.req.cnf.AllowUser))
+	list = append(list, allows...)
+	allows = append(list, s.req.cnf.AllowUser...)
+	if len(allows) == 0 {
+		return "", true
+	}
+	if s.req.User != "" && inStrings(allows, s.req.User) {
+		return "", true
+	}
+	return s.req.User, false
+}
+
 // iPInCIDR 判断IP地址是否在指定的CIDR范围内,支持ipv4和ipv6
 // cidr 示例 "192.168.1.0/24" "2001:db8:1234:5678::/64"
 func iPInCIDR(ip net.IP, cidr string) bool {
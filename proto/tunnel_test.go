@@ -0,0 +1,26 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+func TestIsAllowedKeepsConfig(t *testing.T) {
+	cnf := &conf.Router{AllowIP: []string{"10.0.0.0/8"}, AllowUser: []string{"bob"}}
+	s := &tunnel{req: &Request{cnf: cnf, User: "bob"}, inboundIP: "10.1.2.3"}
+	// 域名配置的切片有多余容量时，合并全局配置不能写到它的底层数组
+	hostIP := make([]string, 1, 4)
+	hostIP[0] = "192.168.0.0/16"
+	hostUser := make([]string, 1, 4)
+	hostUser[0] = "alice"
+	if _, ok := s.isAllowed(hostIP); !ok {
+		t.Fatal("global allowIP not merged")
+	}
+	if _, ok := s.isAllowedUser(hostUser); !ok {
+		t.Fatal("global allowUser not merged")
+	}
+	if hostIP[:2][1] != "" || hostUser[:2][1] != "" {
+		t.Fatal("host allow list backing array modified")
+	}
+}
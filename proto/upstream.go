@@ -0,0 +1,468 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/utils/conf"
+)
+
+const (
+	defaultCheckInterval = 30 * time.Second
+	defaultCheckTimeout  = 3 * time.Second
+)
+
+// member 代理组中的一个代理
+type member struct {
+	up      upstream
+	healthy int32 // 1 可用
+	latency int64 // 最近一次检查耗时，纳秒
+	active  int64 // 正在转发的连接数
+	brk     *breaker
+}
+
+// setHealthy 更新可用状态，变化时记录日志
+func (m *member) setHealthy(ok bool, latency time.Duration) {
+	v := int32(0)
+	if ok {
+		v = 1
+		atomic.StoreInt64(&m.latency, int64(latency))
+	}
+	if atomic.SwapInt32(&m.healthy, v) != v {
+		log.Println("upstream", m.name(), "healthy", ok)
+	}
+}
+
+func (m *member) isHealthy() bool {
+	return atomic.LoadInt32(&m.healthy) == 1
+}
+
+func (m *member) acquire() {
+	atomic.AddInt64(&m.active, 1)
+}
+
+func (m *member) release() {
+	atomic.AddInt64(&m.active, -1)
+}
+
+// name 日志和状态显示，不带认证信息
+func (m *member) name() string {
+	return m.up.scheme + "://" + m.up.addr()
+}
+
+// upstreamGroup 代理组，hosts中逗号分隔的proxy也按failover代理组处理
+type upstreamGroup struct {
+	key      string
+	name     string
+	strategy string
+	fallback string // 都不可用时 last 走本地, deny 禁止
+	check    conf.HealthCheck
+	retries  int // 连接失败时重试次数
+	members  []*member
+	next     uint32 // 轮询位置
+	stop     chan struct{}
+}
+
+// newUpstreamGroup 地址在加载配置时已校验，成员初始为可用，等健康检查更新
+func newUpstreamGroup(key string, u conf.Upstream) *upstreamGroup {
+	g := &upstreamGroup{
+		key:      key,
+		name:     u.Name,
+		strategy: u.Strategy,
+		fallback: u.Fallback,
+		check:    u.Check,
+		retries:  u.Retries,
+		stop:     make(chan struct{}),
+	}
+	if g.retries == 0 {
+		g.retries = 1
+	} else if g.retries < 0 {
+		g.retries = 0
+	}
+	for _, p := range u.Proxies {
+		spec, err := config.ParseProxy(strings.TrimSpace(p))
+		if err != nil {
+			continue
+		}
+		up := upstream{scheme: spec.Scheme, server: spec.Server, port: spec.Port, user: spec.User, token: spec.Token}
+		m := &member{up: up, healthy: 1}
+		m.brk = &breaker{name: m.name()}
+		g.members = append(g.members, m)
+	}
+	return g
+}
+
+// hostUpstream 域名配置使用的代理组，proxy中 " last"、" deny" 结尾作为fallback
+func hostUpstream(cnf *conf.Router, host conf.Host) (key string, u conf.Upstream, ok bool) {
+	if host.Upstream != "" {
+		for _, u := range cnf.Upstreams {
+			if u.Name == host.Upstream {
+				return fmt.Sprintf("upstream:%+v", u), u, true
+			}
+		}
+		return
+	}
+	if host.Proxy == "" {
+		return
+	}
+	u = conf.Upstream{Name: host.Proxy}
+	proxies := host.Proxy
+	if strings.HasSuffix(proxies, " last") || strings.HasSuffix(proxies, " deny") {
+		u.Fallback = proxies[len(proxies)-4:]
+		proxies = proxies[:len(proxies)-5]
+	}
+	u.Proxies = strings.Split(proxies, ",")
+	return "proxy:" + host.Proxy, u, true
+}
+
+var (
+	groupsMu   sync.RWMutex
+	groups     = make(map[string]*upstreamGroup)
+	defaultGrp *upstreamGroup // 全局代理，按只有一个成员的代理组处理
+)
+
+// findGroup 取域名配置的代理组，没有自定义代理时返回nil
+// 配置刚重新加载时旧配置的请求可能找不到，按同样的key登记，熔断和健康状态才能保留，下次同步时不再使用的会停止
+func findGroup(cnf *conf.Router, host conf.Host) *upstreamGroup {
+	key, u, ok := hostUpstream(cnf, host)
+	if !ok {
+		return nil
+	}
+	groupsMu.RLock()
+	g := groups[key]
+	groupsMu.RUnlock()
+	if g != nil {
+		return g
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if g = groups[key]; g == nil {
+		g = newUpstreamGroup(key, u)
+		groups[key] = g
+		go g.run()
+	}
+	return g
+}
+
+// defaultGroup 全局代理 default.proxy 或 -p 的代理组，用于熔断和重试，没有配置时返回nil
+// 不做健康检查，全局代理变化后重建
+func defaultGroup() *upstreamGroup {
+	spec := config.Proxy()
+	if spec.Server == "" || spec.Port == 0 {
+		return nil
+	}
+	key := fmt.Sprintf("default:%v", spec)
+	groupsMu.RLock()
+	g := defaultGrp
+	groupsMu.RUnlock()
+	if g != nil && g.key == key {
+		return g
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if defaultGrp != nil && defaultGrp.key == key {
+		return defaultGrp
+	}
+	up := upstream{scheme: spec.Scheme, server: spec.Server, port: spec.Port, user: spec.User, token: spec.Token}
+	m := &member{up: up, healthy: 1}
+	m.brk = &breaker{name: m.name()}
+	defaultGrp = &upstreamGroup{key: key, name: "default.proxy", retries: 1, members: []*member{m}, stop: make(chan struct{})}
+	return defaultGrp
+}
+
+// syncUpstreams 按配置启动代理组的健康检查，配置未变的保留状态，已删除的停止
+func syncUpstreams(cnf *conf.Router) {
+	want := make(map[string]conf.Upstream)
+	for _, u := range cnf.Upstreams {
+		want[fmt.Sprintf("upstream:%+v", u)] = u
+	}
+	for _, h := range cnf.Hosts {
+		if key, u, ok := hostUpstream(cnf, h); ok {
+			want[key] = u
+		}
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	for key, g := range groups {
+		if _, ok := want[key]; !ok {
+			close(g.stop)
+			delete(groups, key)
+		}
+	}
+	for key, u := range want {
+		if _, ok := groups[key]; !ok {
+			g := newUpstreamGroup(key, u)
+			groups[key] = g
+			go g.run()
+		}
+	}
+}
+
+// StartUpstreams 启动代理组后台健康检查，配置重新加载后同步
+func StartUpstreams() {
+	syncUpstreams(conf.Current())
+	conf.OnReload("upstream", func(old, cnf *conf.Router) {
+		syncUpstreams(cnf)
+	})
+}
+
+// CheckUpstreams 立即检查一次所有代理组，命令行 route explain 使用
+func CheckUpstreams() {
+	syncUpstreams(conf.Current())
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		wg.Add(1)
+		go func(g *upstreamGroup) {
+			defer wg.Done()
+			g.checkAll()
+		}(g)
+	}
+	wg.Wait()
+}
+
+// run 定时检查，启动时先检查一次
+func (g *upstreamGroup) run() {
+	interval := time.Duration(g.check.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	g.checkAll()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			g.checkAll()
+		}
+	}
+}
+
+// checkAll 同时检查所有成员
+func (g *upstreamGroup) checkAll() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			start := time.Now()
+			err := g.probe(m)
+			if err != nil && config.DebugLevel >= config.LevelLong {
+				log.Println("upstream", m.name(), "check err", err)
+			}
+			m.setHealthy(err == nil, time.Since(start))
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe tcp检查连接代理端口，http检查经代理请求url
+func (g *upstreamGroup) probe(m *member) error {
+	timeout := time.Duration(g.check.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultCheckTimeout
+	}
+	if g.check.Type != "http" {
+		conn, err := net.DialTimeout("tcp", m.up.addr(), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	// 经代理连接耗时不好控制，整体超时
+	done := make(chan error, 1)
+	go func() {
+		done <- probeHTTP(m.up, g.check.URL, timeout)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("check timeout after %s", timeout)
+	}
+}
+
+// probeHTTP 经代理请求url，返回2xx或3xx为正常
+func probeHTTP(up upstream, rawurl string, timeout time.Duration) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	s := &tunnel{req: &Request{cnf: conf.Current()}}
+	if err = s.connectVia("", up, "tcp", net.JoinHostPort(u.Hostname(), port)); err != nil {
+		return err
+	}
+	var conn net.Conn = s.conn
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	path := u.RequestURI()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: anyproxy-check\r\nConnection: close\r\n\r\n", path, u.Host)
+	// CONNECT应答的头部可能还没读完，找到HTTP状态行
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "HTTP/") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("bad status line %s", strconv.Quote(line))
+		}
+		code, _ := strconv.Atoi(fields[1])
+		if code < 200 || code >= 400 {
+			return fmt.Errorf("status %s", fields[1])
+		}
+		return nil
+	}
+}
+
+// candidate 按策略选择可用且未熔断的代理，跳过exclude中的，不占用半开的试探机会，都不可用时返回nil
+func (g *upstreamGroup) candidate(dst string, bc breakerConf, exclude map[*member]bool) *member {
+	var healthy []*member
+	for _, m := range g.members {
+		if m.isHealthy() && !exclude[m] && m.brk.available(bc) {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	return g.choose(dst, healthy)
+}
+
+// pick 连接前选择代理，半开的代理占用试探机会，跳过exclude中已试过的，都不可用时返回nil
+func (g *upstreamGroup) pick(dst string, bc breakerConf, exclude map[*member]bool) *member {
+	for {
+		m := g.candidate(dst, bc, exclude)
+		if m == nil || m.brk.ready(bc) {
+			return m
+		}
+		// 半开的试探机会被其它请求占用，排除后重新选择
+		skip := map[*member]bool{m: true}
+		for k := range exclude {
+			skip[k] = true
+		}
+		exclude = skip
+	}
+}
+
+// choose 按策略从可用的代理中选一个
+func (g *upstreamGroup) choose(dst string, healthy []*member) *member {
+	switch g.strategy {
+	case "roundrobin":
+		n := atomic.AddUint32(&g.next, 1)
+		return healthy[(n-1)%uint32(len(healthy))]
+	case "leastconn":
+		best := healthy[0]
+		for _, m := range healthy[1:] {
+			if atomic.LoadInt64(&m.active) < atomic.LoadInt64(&best.active) {
+				best = m
+			}
+		}
+		return best
+	case "hash":
+		// rendezvous 哈希，成员增减时只影响部分目标
+		var best *member
+		var max uint32
+		for _, m := range healthy {
+			h := fnv.New32a()
+			h.Write([]byte(dst + "|" + m.name()))
+			if v := h.Sum32(); best == nil || v > max {
+				best, max = m, v
+			}
+		}
+		return best
+	case "latency":
+		best := healthy[0]
+		for _, m := range healthy[1:] {
+			if atomic.LoadInt64(&m.latency) < atomic.LoadInt64(&best.latency) {
+				best = m
+			}
+		}
+		return best
+	default:
+		return healthy[0]
+	}
+}
+
+// UpstreamMember 代理状态
+type UpstreamMember struct {
+	Proxy   string  `json:"proxy"`
+	Healthy bool    `json:"healthy"`
+	Latency float64 `json:"latencyMs"` // 最近一次检查耗时，毫秒
+	Active  int64   `json:"active"`    // 正在转发的连接数
+	Breaker string  `json:"breaker"`   // 熔断状态 closed、open、half-open
+	Fails   int     `json:"failures"`  // 连续失败次数
+}
+
+// UpstreamStatus 代理组状态
+type UpstreamStatus struct {
+	Name     string           `json:"name"`
+	Strategy string           `json:"strategy"`
+	Check    string           `json:"check"`
+	Members  []UpstreamMember `json:"members"`
+}
+
+// Upstreams 所有代理组的健康状态
+func Upstreams() []UpstreamStatus {
+	def := defaultGroup()
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	all := make([]*upstreamGroup, 0, len(groups)+1)
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	if def != nil {
+		all = append(all, def)
+	}
+	list := make([]UpstreamStatus, 0, len(all))
+	for _, g := range all {
+		st := UpstreamStatus{
+			Name:     g.name,
+			Strategy: config.IfEmptyThen(g.strategy, "failover", ""),
+			Check:    config.IfEmptyThen(g.check.Type, "tcp", ""),
+		}
+		for _, m := range g.members {
+			state, failures := m.brk.status()
+			st.Members = append(st.Members, UpstreamMember{
+				Proxy:   m.name(),
+				Healthy: m.isHealthy(),
+				Latency: float64(atomic.LoadInt64(&m.latency)) / float64(time.Millisecond),
+				Active:  atomic.LoadInt64(&m.active),
+				Breaker: state,
+				Fails:   failures,
+			})
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
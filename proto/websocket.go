@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"io"
 	"log"
+	"net"
 
 	"github.com/keminar/anyproxy/config"
 	"github.com/keminar/anyproxy/nat"
 	"github.com/keminar/anyproxy/proto/http"
-	"github.com/keminar/anyproxy/utils/conf"
+	"github.com/keminar/anyproxy/utils/tools"
 	"github.com/keminar/anyproxy/utils/trace"
 )
 
@@ -38,9 +39,9 @@ func (s *wsTunnel) getTarget(dstName string) (ok bool) {
 	if dstName == "" {
 		return false
 	}
-	host := findHost(dstName, dstName)
+	host, _ := findHost(s.req.cnf, dstName, dstName, s.req.DstPort, tools.GetRemoteIp(s.req.conn.RemoteAddr().String()), s.req.User)
 	var confTarget string
-	confTarget = getString(host.Target, conf.RouterConfig.Default.Target, "auto")
+	confTarget = getString(host.Target, s.req.cnf.Default.Target, "auto")
 
 	if confTarget == "deny" {
 		return false
@@ -60,7 +61,12 @@ func (s *wsTunnel) transfer() bool {
 		log.Println(trace.ID(s.req.ID), "websocket subscribe not found")
 		return false
 	}
-	b := nat.ServerBridge.Register(c, s.req.ID, s.req.conn)
+	tcpConn, ok := s.req.conn.(*net.TCPConn)
+	if !ok {
+		log.Println(trace.ID(s.req.ID), "websocket subscribe need tcp conn")
+		return false
+	}
+	b := nat.ServerBridge.Register(c, s.req.ID, tcpConn)
 	defer func() {
 		b.Unregister()
 	}()
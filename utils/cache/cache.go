@@ -1,11 +1,19 @@
 package cache
 
 import (
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/dns"
 	"github.com/keminar/anyproxy/utils/trace"
 )
 
@@ -13,7 +21,7 @@ import (
 var ResolveLookup *resolveLookupCache
 
 func init() {
-	ResolveLookup = newResolveLookupCache()
+	ResolveLookup = newResolveLookupCache(DefaultOptions)
 }
 
 // DialState 状态
@@ -22,70 +30,313 @@ type DialState int
 const (
 	//StateNew 新值，未dial失败值
 	StateNew DialState = iota
-	//StateFail ipv4地址 dial失败
+	//StateFail 所有ip地址 dial失败
 	StateFail
 	//StateNone 不存在的地址
 	StateNone
 )
 
+// shardCount 分片数，每个分片单独加锁
+const shardCount = 16
+
+// Options 缓存设置
+type Options struct {
+	Size        int           //最多缓存的域名数
+	MinTTL      time.Duration //记录ttl小于此值时按此值缓存
+	MaxTTL      time.Duration //记录ttl大于此值时按此值缓存
+	NegativeTTL time.Duration //域名不存在时的缓存时间，SOA中有时取两者较小的
+	DefaultTTL  time.Duration //解析结果没有ttl时使用，如系统解析
+}
+
+// DefaultOptions 默认设置
+var DefaultOptions = Options{
+	Size:        65536,
+	MinTTL:      time.Minute,
+	MaxTTL:      time.Hour,
+	NegativeTTL: 30 * time.Second,
+	DefaultTTL:  10 * time.Minute,
+}
+
+// Stats 缓存统计
+type Stats struct {
+	Hits         uint64 `json:"hits"`         //命中
+	NegativeHits uint64 `json:"negativeHits"` //命中域名不存在
+	Misses       uint64 `json:"misses"`       //未命中
+	Coalesced    uint64 `json:"coalesced"`    //未命中时等待同一域名正在进行的解析
+	Evictions    uint64 `json:"evictions"`    //超出数量淘汰
+	Entries      int    `json:"entries"`      //当前缓存数
+}
+
 type cacheEntry struct {
-	ipv4    string    //ip v4地址
-	state   DialState //是否可连通
-	expires time.Time
+	key      string
+	ips      []net.IP
+	notFound bool //域名不存在
+	expires  time.Time
+}
+
+// call 进行中的解析，同一域名的其它请求等待结果
+type call struct {
+	wg  sync.WaitGroup
+	ips []net.IP
+	err error
 }
+
+type shard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // 最近使用的在前
+	calls map[string]*call
+}
+
 type resolveLookupCache struct {
-	ips  map[string]*cacheEntry
-	keys []string
-	next int
-	mu   sync.Mutex
+	stats  Stats // 计数用原子操作，放在开头保证64位对齐
+	opts   atomic.Value
+	shards [shardCount]*shard
 }
 
 // newResolveLookupCache 初始化
-func newResolveLookupCache() *resolveLookupCache {
-	return &resolveLookupCache{
-		ips:  make(map[string]*cacheEntry),
-		keys: make([]string, 65536),
+func newResolveLookupCache(opts Options) *resolveLookupCache {
+	c := &resolveLookupCache{}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+			calls: make(map[string]*call),
+		}
+	}
+	c.opts.Store(opts)
+	return c
+}
+
+// SetOptions 修改设置，为0的项用默认值，数量变小时在下次写入时淘汰
+func (c *resolveLookupCache) SetOptions(opts Options) {
+	if opts.Size <= 0 {
+		opts.Size = DefaultOptions.Size
+	}
+	if opts.MinTTL <= 0 {
+		opts.MinTTL = DefaultOptions.MinTTL
 	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = DefaultOptions.MaxTTL
+	}
+	if opts.MaxTTL < opts.MinTTL {
+		opts.MaxTTL = opts.MinTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultOptions.NegativeTTL
+	}
+	if opts.DefaultTTL <= 0 {
+		opts.DefaultTTL = DefaultOptions.DefaultTTL
+	}
+	c.opts.Store(opts)
 }
 
-// Lookup 查找
-func (c *resolveLookupCache) Lookup(logID uint, host string) (string, DialState) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	hit := c.ips[host]
-	if hit != nil {
-		if hit.expires.After(time.Now()) {
+func (c *resolveLookupCache) options() Options {
+	return c.opts.Load().(Options)
+}
+
+func (c *resolveLookupCache) shard(key string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%shardCount]
+}
+
+// Resolve 查找缓存，未命中时调用fn解析并按ttl保存，同一域名同时未命中只解析一次
+// fn返回的ttl为0时用默认时间，返回dns.ErrNotFound时做否定缓存
+func (c *resolveLookupCache) Resolve(logID uint, key string, fn func() ([]net.IP, time.Duration, error)) ([]net.IP, error) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	if e, ok := sh.items[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if entry.expires.After(time.Now()) {
+			sh.lru.MoveToFront(e)
+			sh.mu.Unlock()
 			if config.DebugLevel >= config.LevelDebug {
-				log.Println(trace.ID(logID), "lookup(): CACHE_HIT", hit.state)
+				log.Println(trace.ID(logID), "lookup(): CACHE_HIT", key, len(entry.ips))
+			}
+			if entry.notFound {
+				atomic.AddUint64(&c.stats.NegativeHits, 1)
+				return nil, dns.ErrNotFound
 			}
-			return hit.ipv4, hit.state
+			atomic.AddUint64(&c.stats.Hits, 1)
+			return entry.ips, nil
 		}
+		sh.remove(e)
 		if config.DebugLevel >= config.LevelDebug {
-			log.Println(trace.ID(logID), "lookup(): CACHE_EXPIRED")
+			log.Println(trace.ID(logID), "lookup(): CACHE_EXPIRED", key)
 		}
-		delete(c.ips, host)
-	} else {
-		if config.DebugLevel >= config.LevelDebug {
-			log.Println(trace.ID(logID), "lookup(): CACHE_MISS")
+	} else if config.DebugLevel >= config.LevelDebug {
+		log.Println(trace.ID(logID), "lookup(): CACHE_MISS", key)
+	}
+	atomic.AddUint64(&c.stats.Misses, 1)
+	if cl, ok := sh.calls[key]; ok {
+		sh.mu.Unlock()
+		atomic.AddUint64(&c.stats.Coalesced, 1)
+		cl.wg.Wait()
+		return cl.ips, cl.err
+	}
+	cl := &call{}
+	cl.wg.Add(1)
+	sh.calls[key] = cl
+	sh.mu.Unlock()
+
+	ips, ttl, err := fn()
+	cl.ips, cl.err = ips, err
+
+	sh.mu.Lock()
+	delete(sh.calls, key)
+	// 解析出错时不缓存，下次重新解析
+	if err == nil && len(ips) > 0 {
+		c.store(sh, &cacheEntry{key: key, ips: ips, expires: time.Now().Add(c.clampTTL(ttl, false))})
+	} else if err == dns.ErrNotFound {
+		c.store(sh, &cacheEntry{key: key, notFound: true, expires: time.Now().Add(c.clampTTL(ttl, true))})
+	}
+	sh.mu.Unlock()
+	cl.wg.Done()
+	return ips, err
+}
+
+// clampTTL 限制在设置的范围内，否定缓存不超过NegativeTTL
+func (c *resolveLookupCache) clampTTL(ttl time.Duration, notFound bool) time.Duration {
+	opts := c.options()
+	if notFound {
+		if ttl <= 0 || ttl > opts.NegativeTTL {
+			return opts.NegativeTTL
 		}
+		return ttl
 	}
-	return "", StateNone
+	if ttl <= 0 {
+		ttl = opts.DefaultTTL
+	}
+	if ttl < opts.MinTTL {
+		return opts.MinTTL
+	}
+	if ttl > opts.MaxTTL {
+		return opts.MaxTTL
+	}
+	return ttl
 }
 
-// Store 保存，只有65535个位置，删除之前的占用
-func (c *resolveLookupCache) Store(host, ipv4 string, state DialState, d time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	hit := c.ips[host]
-	if hit != nil {
-		hit.ipv4 = ipv4
-		hit.state = state
-		hit.expires = time.Now().Add(d)
+// store 保存并淘汰最久未使用的，调用方持有分片锁
+func (c *resolveLookupCache) store(sh *shard, entry *cacheEntry) {
+	if e, ok := sh.items[entry.key]; ok {
+		e.Value = entry
+		sh.lru.MoveToFront(e)
 		return
 	}
-	// 删除原位置内的值
-	delete(c.ips, c.keys[c.next])
-	c.keys[c.next] = host
-	c.next = (c.next + 1) & 65535
-	c.ips[host] = &cacheEntry{ipv4: ipv4, state: state, expires: time.Now().Add(d)}
+	sh.items[entry.key] = sh.lru.PushFront(entry)
+	limit := c.options().Size / shardCount
+	if limit < 1 {
+		limit = 1
+	}
+	for sh.lru.Len() > limit {
+		sh.remove(sh.lru.Back())
+		atomic.AddUint64(&c.stats.Evictions, 1)
+	}
+}
+
+func (sh *shard) remove(e *list.Element) {
+	sh.lru.Remove(e)
+	delete(sh.items, e.Value.(*cacheEntry).key)
+}
+
+// Stats 缓存统计
+func (c *resolveLookupCache) Stats() Stats {
+	s := Stats{
+		Hits:         atomic.LoadUint64(&c.stats.Hits),
+		NegativeHits: atomic.LoadUint64(&c.stats.NegativeHits),
+		Misses:       atomic.LoadUint64(&c.stats.Misses),
+		Coalesced:    atomic.LoadUint64(&c.stats.Coalesced),
+		Evictions:    atomic.LoadUint64(&c.stats.Evictions),
+	}
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		s.Entries += sh.lru.Len()
+		sh.mu.Unlock()
+	}
+	return s
+}
+
+// Flush 清空缓存
+func (c *resolveLookupCache) Flush() {
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		sh.items = make(map[string]*list.Element)
+		sh.lru.Init()
+		sh.mu.Unlock()
+	}
+}
+
+// snapshotEntry 保存到文件的缓存项
+type snapshotEntry struct {
+	Key      string    `json:"key"`
+	IPs      []string  `json:"ips,omitempty"`
+	NotFound bool      `json:"notFound,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Save 保存未过期的缓存到文件，先写临时文件再改名
+func (c *resolveLookupCache) Save(path string) error {
+	var list []snapshotEntry
+	now := time.Now()
+	for _, sh := range c.shards {
+		sh.mu.Lock()
+		for e := sh.lru.Back(); e != nil; e = e.Prev() {
+			entry := e.Value.(*cacheEntry)
+			if !entry.expires.After(now) {
+				continue
+			}
+			se := snapshotEntry{Key: entry.key, NotFound: entry.notFound, Expires: entry.expires}
+			for _, ip := range entry.ips {
+				se.IPs = append(se.IPs, ip.String())
+			}
+			list = append(list, se)
+		}
+		sh.mu.Unlock()
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load 从文件加载缓存，跳过已过期的，文件不存在时不报错
+func (c *resolveLookupCache) Load(path string) (n int, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var list []snapshotEntry
+	if err = json.Unmarshal(data, &list); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	for _, se := range list {
+		if !se.Expires.After(now) {
+			continue
+		}
+		entry := &cacheEntry{key: se.Key, notFound: se.NotFound, expires: se.Expires}
+		for _, s := range se.IPs {
+			if ip := net.ParseIP(s); ip != nil {
+				entry.ips = append(entry.ips, ip)
+			}
+		}
+		if !entry.notFound && len(entry.ips) == 0 {
+			continue
+		}
+		sh := c.shard(se.Key)
+		sh.mu.Lock()
+		c.store(sh, entry)
+		sh.mu.Unlock()
+		n++
+	}
+	return n, nil
 }
@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/keminar/anyproxy/dns"
+)
+
+func testCache() *resolveLookupCache {
+	c := newResolveLookupCache(DefaultOptions)
+	c.SetOptions(Options{
+		Size:        shardCount * 2,
+		MinTTL:      time.Minute,
+		MaxTTL:      time.Hour,
+		NegativeTTL: 30 * time.Second,
+		DefaultTTL:  10 * time.Minute,
+	})
+	return c
+}
+
+// ttlOf 缓存项剩余时间，不存在时为0
+func ttlOf(c *resolveLookupCache, key string) time.Duration {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if e, ok := sh.items[key]; ok {
+		return time.Until(e.Value.(*cacheEntry).expires)
+	}
+	return 0
+}
+
+func cached(c *resolveLookupCache, key string) bool {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	_, ok := sh.items[key]
+	return ok
+}
+
+func TestResolveCoalesce(t *testing.T) {
+	c := testCache()
+	const n = 50
+	var calls int32
+	release := make(chan struct{})
+	fn := func() ([]net.IP, time.Duration, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []net.IP{net.ParseIP("1.2.3.4")}, time.Minute, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := c.Resolve(0, "www.example.com", fn)
+			if err != nil || len(ips) != 1 {
+				errs <- fmt.Errorf("ips %v err %v", ips, err)
+			}
+		}()
+	}
+	// 所有请求都未命中后再返回解析结果
+	for atomic.LoadUint64(&c.stats.Misses) < n {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("fn called %d times, want 1", calls)
+	}
+	if s := c.Stats(); s.Coalesced != n-1 || s.Entries != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestResolveNegative(t *testing.T) {
+	c := testCache()
+	var calls int32
+	notFound := func(ttl time.Duration) func() ([]net.IP, time.Duration, error) {
+		return func() ([]net.IP, time.Duration, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, ttl, dns.ErrNotFound
+		}
+	}
+
+	// SOA的ttl小于NegativeTTL时用SOA的
+	if _, err := c.Resolve(0, "nx.example.com", notFound(5*time.Second)); err != dns.ErrNotFound {
+		t.Fatalf("err = %v", err)
+	}
+	if ttl := ttlOf(c, "nx.example.com"); ttl <= 4*time.Second || ttl > 5*time.Second {
+		t.Fatalf("negative ttl = %v, want 5s", ttl)
+	}
+	if _, err := c.Resolve(0, "nx.example.com", notFound(0)); err != dns.ErrNotFound || calls != 1 {
+		t.Fatalf("cached nxdomain err = %v calls = %d", err, calls)
+	}
+	if c.Stats().NegativeHits != 1 {
+		t.Fatal("negative hit not counted")
+	}
+
+	// 没有SOA或超过NegativeTTL时用NegativeTTL
+	for _, ttl := range []time.Duration{0, time.Hour} {
+		key := fmt.Sprintf("nx%d.example.com", ttl)
+		c.Resolve(0, key, notFound(ttl))
+		if got := ttlOf(c, key); got <= 29*time.Second || got > 30*time.Second {
+			t.Fatalf("negative ttl for %v = %v, want 30s", ttl, got)
+		}
+	}
+
+	// 过期后重新解析
+	sh := c.shard("nx.example.com")
+	sh.mu.Lock()
+	sh.items["nx.example.com"].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	sh.mu.Unlock()
+	c.Resolve(0, "nx.example.com", notFound(0))
+	if calls != 4 {
+		t.Fatalf("expired nxdomain not resolved again, calls = %d", calls)
+	}
+
+	// 其它错误不缓存
+	c.Resolve(0, "err.example.com", func() ([]net.IP, time.Duration, error) {
+		return nil, time.Minute, errors.New("timeout")
+	})
+	if cached(c, "err.example.com") {
+		t.Fatal("lookup error cached")
+	}
+}
+
+func TestClampTTL(t *testing.T) {
+	c := testCache()
+	tests := []struct {
+		ttl      time.Duration
+		notFound bool
+		want     time.Duration
+	}{
+		{0, false, 10 * time.Minute},
+		{time.Second, false, time.Minute},
+		{5 * time.Minute, false, 5 * time.Minute},
+		{48 * time.Hour, false, time.Hour},
+		{0, true, 30 * time.Second},
+		{time.Second, true, time.Second},
+		{time.Hour, true, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := c.clampTTL(tt.ttl, tt.notFound); got != tt.want {
+			t.Errorf("clampTTL(%v, %v) = %v, want %v", tt.ttl, tt.notFound, got, tt.want)
+		}
+	}
+
+	// MaxTTL小于MinTTL时按MinTTL
+	c.SetOptions(Options{MinTTL: time.Hour, MaxTTL: time.Minute})
+	if got := c.clampTTL(24*time.Hour, false); got != time.Hour {
+		t.Fatalf("clampTTL = %v, want 1h", got)
+	}
+}
+
+func TestResolveEviction(t *testing.T) {
+	c := testCache()
+	// 取同一分片的3个域名，每个分片最多2个
+	var keys []string
+	sh := c.shard("a0.example.com")
+	for i := 0; len(keys) < 3; i++ {
+		key := fmt.Sprintf("a%d.example.com", i)
+		if c.shard(key) == sh {
+			keys = append(keys, key)
+		}
+	}
+	fn := func() ([]net.IP, time.Duration, error) {
+		return []net.IP{net.ParseIP("1.2.3.4")}, time.Minute, nil
+	}
+	c.Resolve(0, keys[0], fn)
+	c.Resolve(0, keys[1], fn)
+	// 命中后变为最近使用，淘汰keys[1]
+	c.Resolve(0, keys[0], fn)
+	c.Resolve(0, keys[2], fn)
+	if !cached(c, keys[0]) || cached(c, keys[1]) || !cached(c, keys[2]) {
+		t.Fatalf("eviction order wrong: %v %v %v", cached(c, keys[0]), cached(c, keys[1]), cached(c, keys[2]))
+	}
+	if c.Stats().Evictions != 1 {
+		t.Fatalf("evictions = %d", c.Stats().Evictions)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := testCache()
+	now := time.Now()
+	for _, e := range []*cacheEntry{
+		{key: "www.example.com", ips: []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("::1")}, expires: now.Add(time.Hour)},
+		{key: "nx.example.com", notFound: true, expires: now.Add(time.Minute)},
+		{key: "soon.example.com", ips: []net.IP{net.ParseIP("5.6.7.8")}, expires: now.Add(50 * time.Millisecond)},
+		{key: "old.example.com", ips: []net.IP{net.ParseIP("9.9.9.9")}, expires: now.Add(-time.Second)},
+	} {
+		sh := c.shard(e.key)
+		sh.mu.Lock()
+		c.store(sh, e)
+		sh.mu.Unlock()
+	}
+
+	path := filepath.Join(t.TempDir(), "dns.json")
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "old.example.com") || !strings.Contains(string(data), "soon.example.com") {
+		t.Fatalf("snapshot = %s", data)
+	}
+
+	// 保存后才过期的加载时跳过
+	time.Sleep(100 * time.Millisecond)
+	c2 := testCache()
+	n, err := c2.Load(path)
+	if err != nil || n != 2 {
+		t.Fatalf("loaded %d err %v, want 2", n, err)
+	}
+	ips, err := c2.Resolve(0, "www.example.com", func() ([]net.IP, time.Duration, error) {
+		return nil, 0, errors.New("not cached")
+	})
+	if err != nil || len(ips) != 2 || !ips[1].Equal(net.ParseIP("::1")) {
+		t.Fatalf("ips %v err %v", ips, err)
+	}
+	if _, err = c2.Resolve(0, "nx.example.com", nil); err != dns.ErrNotFound {
+		t.Fatalf("nxdomain err = %v", err)
+	}
+	if cached(c2, "soon.example.com") || cached(c2, "old.example.com") {
+		t.Fatal("expired entries loaded")
+	}
+
+	if n, err = c2.Load(filepath.Join(t.TempDir(), "missing.json")); n != 0 || err != nil {
+		t.Fatalf("missing file n %d err %v", n, err)
+	}
+}
@@ -3,75 +3,120 @@ package conf
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-// RouterConfig 配置
-var RouterConfig *Router
+// routerConfig 当前生效的配置 *Router，重新加载时整体替换
+var routerConfig atomic.Value
+
+// Current 当前配置快照，未加载时为nil，取得后内容不会再变化
+func Current() *Router {
+	cnf, _ := routerConfig.Load().(*Router)
+	return cnf
+}
 
 // LoadAllConfig 加载顺序要求，不写成init
 func LoadAllConfig(filePath string) {
-	var err error
-	if filePath == "" {
-		filePath, err = GetPath("router.yaml")
-	} else if !fileExists(filePath) {
-		filePath, err = GetPath(filePath)
-	}
+	filePath, err := configPath(filePath)
 	if err != nil {
 		log.Println(fmt.Sprintf("config file %s path err:%s", "router", err.Error()))
 		return
 	}
 	conf, err := LoadRouterConfig(filePath)
 	if err != nil {
-		log.Println(fmt.Sprintf("config file %s load err:%s", "router", err.Error()))
+		logConfigErr(filePath, err)
 		return
 	}
-	RouterConfig = &conf
+	ConfigFile = filePath
+	routerConfig.Store(&conf)
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
 	if conf.Watcher {
-		go notify(filePath)
+		newWatcher(filePath)
 	}
+	loadRuleSets(&conf)
 }
 
-func notify(filePath string) {
-	watcher, err := fsnotify.NewWatcher()
+// CheckConfig 检查配置文件，返回实际的配置文件路径和所有错误
+func CheckConfig(filePath string) (string, error) {
+	filePath, err := configPath(filePath)
 	if err != nil {
-		log.Println("config new notify watcher err", err)
-		return
+		return filePath, err
+	}
+	_, err = LoadRouterConfig(filePath)
+	return filePath, err
+}
+
+// configPath 为空时用默认的router.yaml，文件不存在时到conf目录查找
+func configPath(filePath string) (string, error) {
+	if filePath == "" {
+		return GetPath("router.yaml")
+	} else if !fileExists(filePath) {
+		return GetPath(filePath)
 	}
-	defer watcher.Close()
+	return filePath, nil
+}
 
-	done := make(chan bool)
-	go func() {
-		defer close(done)
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					conf, err := LoadRouterConfig(filePath)
-					if err != nil {
-						log.Println(fmt.Sprintf("config file %s load err:%s", "router", err.Error()))
-					} else {
-						RouterConfig = &conf
-						log.Println("config file reloaded:", filePath)
-					}
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("config notify watcher error:", err)
-			}
+// logConfigErr 配置错误逐条输出
+func logConfigErr(filePath string, err error) {
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, e := range errs {
+			log.Println(fmt.Sprintf("config file %s load err:%s", filePath, e.Error()))
 		}
-	}()
+		return
+	}
+	log.Println(fmt.Sprintf("config file %s load err:%s", filePath, err.Error()))
+}
 
-	err = watcher.Add(filePath)
+// watcher 监听配置文件和本地规则集文件，读写需持有reloadMu
+var watcher *fsnotify.Watcher
+
+// newWatcher 创建监听，规则集文件在加载时再加入，调用方需持有reloadMu
+func newWatcher(filePath string) {
+	w, err := fsnotify.NewWatcher()
 	if err != nil {
+		log.Println("config new notify watcher err", err)
+		return
+	}
+	if err = w.Add(filePath); err != nil {
 		log.Println("config notify add file err", err)
+		w.Close()
 		return
 	}
-	<-done
+	watcher = w
+	go notify(w, filePath)
+}
+
+func notify(w *fsnotify.Watcher, filePath string) {
+	defer func() {
+		w.Close()
+		reloadMu.Lock()
+		if watcher == w {
+			watcher = nil
+		}
+		reloadMu.Unlock()
+	}()
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Write != fsnotify.Write {
+				continue
+			}
+			if event.Name != filePath {
+				reloadRuleSetFile(event.Name)
+				continue
+			}
+			Reload("watcher")
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Println("config notify watcher error:", err)
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package conf
 
 import (
+	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -12,6 +13,9 @@ var AppSrcPath string
 // AppPath 二进制文件根目录
 var AppPath string
 
+// ConfigFile 已加载的配置文件路径
+var ConfigFile string
+
 func init() {
 	_, file, _, _ := runtime.Caller(0)
 	upDir := ".." + string(filepath.Separator)
@@ -24,3 +28,42 @@ func init() {
 		panic(err)
 	}
 }
+
+// CacheDir 缓存目录，默认为配置文件所在目录下的cache
+func CacheDir() string {
+	dir := ""
+	if cnf := Current(); cnf != nil && cnf.CacheDir != "" {
+		dir = RelPath(cnf.CacheDir)
+	} else {
+		dir = RelPath("cache")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("cache dir", dir, "err", err)
+	}
+	return dir
+}
+
+// findFile 相对路径依次在当前目录、程序目录和配置文件所在目录查找，都不存在时用当前目录
+func findFile(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	for _, dir := range []string{".", AppPath, filepath.Dir(RelPath("x"))} {
+		path := filepath.Join(dir, name)
+		if fileExists(path) {
+			if abs, err := filepath.Abs(path); err == nil {
+				return abs
+			}
+			return path
+		}
+	}
+	return name
+}
+
+// RelPath 相对路径以配置文件所在目录为准
+func RelPath(name string) string {
+	if name == "" || filepath.IsAbs(name) || ConfigFile == "" {
+		return name
+	}
+	return filepath.Join(filepath.Dir(ConfigFile), name)
+}
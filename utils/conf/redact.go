@@ -0,0 +1,68 @@
+package conf
+
+import "regexp"
+
+const redacted = "***"
+
+var (
+	// proxyUserRe 代理地址中的认证信息
+	proxyUserRe = regexp.MustCompile(`://[^/@\s]+@`)
+	// proxyTokenRe 代理地址中的通信密钥
+	proxyTokenRe = regexp.MustCompile(`([?&]token=)[^&\s]*`)
+)
+
+// redactProxy 隐藏代理地址中的密码和密钥
+func redactProxy(proxy string) string {
+	proxy = proxyUserRe.ReplaceAllString(proxy, "://"+redacted+"@")
+	return proxyTokenRe.ReplaceAllString(proxy, "${1}"+redacted)
+}
+
+// redactString 非空时替换
+func redactString(s string) string {
+	if s == "" {
+		return s
+	}
+	return redacted
+}
+
+// redactUsers 隐藏密码
+func redactUsers(users []User) []User {
+	list := make([]User, len(users))
+	for i, u := range users {
+		list[i] = User{Name: u.Name, Pass: redactString(u.Pass)}
+	}
+	return list
+}
+
+// Redacted 隐藏密码、密钥后的配置副本，管理接口显示用
+func (cnf *Router) Redacted() Router {
+	r := *cnf
+	r.Token = redactString(r.Token)
+	r.Admin.Token = redactString(r.Admin.Token)
+	r.Websocket.Pass = redactString(r.Websocket.Pass)
+	r.Socks5.Users = redactUsers(r.Socks5.Users)
+	r.HTTP.Users = redactUsers(r.HTTP.Users)
+	r.Default.Proxy = redactProxy(r.Default.Proxy)
+
+	r.Tunnel.Tokens = make([]TunnelToken, len(cnf.Tunnel.Tokens))
+	for i, tk := range cnf.Tunnel.Tokens {
+		tk.Token = redactString(tk.Token)
+		r.Tunnel.Tokens[i] = tk
+	}
+	r.Hosts = make([]Host, len(cnf.Hosts))
+	for i, h := range cnf.Hosts {
+		h.Token = redactString(h.Token)
+		h.Proxy = redactProxy(h.Proxy)
+		r.Hosts[i] = h
+	}
+	r.Upstreams = make([]Upstream, len(cnf.Upstreams))
+	for i, u := range cnf.Upstreams {
+		proxies := make([]string, len(u.Proxies))
+		for j, p := range u.Proxies {
+			proxies[j] = redactProxy(p)
+		}
+		u.Proxies = proxies
+		r.Upstreams[i] = u
+	}
+	return r
+}
@@ -0,0 +1,68 @@
+package conf
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// ReloadHandler 配置重新加载后的回调，old为旧配置，cnf为新配置
+type ReloadHandler func(old, cnf *Router)
+
+type reloadSubscriber struct {
+	name string
+	fn   ReloadHandler
+}
+
+var (
+	reloadMu    sync.Mutex // 重新加载串行执行
+	subscribeMu sync.RWMutex
+	subscribers []reloadSubscriber
+)
+
+// OnReload 订阅配置重新加载事件，回调按订阅顺序在新配置生效后执行
+func OnReload(name string, fn ReloadHandler) {
+	subscribeMu.Lock()
+	subscribers = append(subscribers, reloadSubscriber{name: name, fn: fn})
+	subscribeMu.Unlock()
+}
+
+// Reload 重新读取配置文件，校验出错时保留旧配置，from为触发来源用于日志
+func Reload(from string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if ConfigFile == "" {
+		return errors.New("config file is not loaded")
+	}
+	cnf, err := LoadRouterConfig(ConfigFile)
+	if err != nil {
+		logConfigErr(ConfigFile, err)
+		return err
+	}
+	old := Current()
+	routerConfig.Store(&cnf)
+	log.Println("config file reloaded by", from, ConfigFile)
+
+	if cnf.Watcher && watcher == nil {
+		newWatcher(ConfigFile)
+	}
+	loadRuleSets(&cnf)
+
+	subscribeMu.RLock()
+	list := subscribers
+	subscribeMu.RUnlock()
+	for _, sub := range list {
+		notifySubscriber(sub, old, &cnf)
+	}
+	return nil
+}
+
+// notifySubscriber 单个订阅者出错不影响其它订阅者
+func notifySubscriber(sub reloadSubscriber, old, cnf *Router) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Println("config reload subscriber", sub.name, "panic", err)
+		}
+	}()
+	sub.fn(old, cnf)
+}
@@ -2,10 +2,16 @@ package conf
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -17,14 +23,182 @@ type PortMap struct {
 
 // Host 域名
 type Host struct {
-	Name    string    `yaml:"name"`    //域名关键字
-	Match   string    `yaml:"match"`   //contain 包含, equal 完全相等, preg 正则
-	Target  string    `yaml:"target"`  //local 当前环境, remote 远程, deny 禁止, auto根据dial选择
-	DNS     string    `yaml:"dns"`     //local 当前环境, remote 远程, 仅当target使用remote有效
-	IP      string    `yaml:"ip"`      //本地解析ip
-	Port    []PortMap `yaml:"port"`    //目标端口转换
-	Proxy   string    `yaml:"proxy"`   //指定代理服务器
-	AllowIP []string  `yaml:"allowIP"` //可以访问的客户端IP
+	Name      string    `yaml:"name"`      //域名关键字，为空时只按ports和source匹配
+	Match     string    `yaml:"match"`     //contain 包含, equal 完全相等, suffix 域名后缀, glob 通配符, preg 正则, cidr 目标网段
+	Target    string    `yaml:"target"`    //local 当前环境, remote 远程, deny 禁止, auto根据dial选择
+	DNS       string    `yaml:"dns"`       //local 当前环境, remote 远程(仅当target使用remote有效), 或dns.servers的名称，多个逗号分隔同时查询
+	IP        string    `yaml:"ip"`        //本地解析ip
+	Prefer    string    `yaml:"prefer"`    //直连时优先的地址类型 ipv4 或 ipv6，默认ipv4，两种地址交替尝试
+	Port      []PortMap `yaml:"port"`      //目标端口转换
+	Proxy     string    `yaml:"proxy"`     //指定代理服务器
+	Upstream  string    `yaml:"upstream"`  //使用的代理组名称，配置后忽略proxy
+	Token     string    `yaml:"token"`     //和tunnel通信密钥，为空用代理地址或全局的token
+	AllowIP   []string  `yaml:"allowIP"`   //可以访问的客户端IP
+	User      []string  `yaml:"user"`      //仅对指定的登录用户生效，为空对所有用户生效
+	AllowUser []string  `yaml:"allowUser"` //可以访问的登录用户
+	Ports     []string  `yaml:"ports"`     //目标端口，如 3306 或 8000-8100，为空不限制
+	Source    []string  `yaml:"source"`    //客户端来源ip或网段，为空不限制
+	Ruleset   string    `yaml:"ruleset"`   //规则集，如 file://conf/rules/intranet.txt 或 http(s)://地址，配置后name只作为名称
+	Format    string    `yaml:"format"`    //规则集格式 plain 每行一个域名, hosts 文件, clash rule-provider，为空自动识别
+	Interval  int       `yaml:"interval"`  //远程规则集刷新间隔秒数，默认86400
+
+	pattern *regexp.Regexp //preg和glob加载配置时编译好的正则
+	cidr    *net.IPNet     //cidr 目标网段
+	ports   []PortRange
+	sources []*net.IPNet
+}
+
+// PortRange 端口范围
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Pattern 预编译的正则，非preg和glob时为nil
+func (h Host) Pattern() *regexp.Regexp {
+	return h.pattern
+}
+
+// CIDR 目标网段，非cidr时为nil
+func (h Host) CIDR() *net.IPNet {
+	return h.cidr
+}
+
+// HasCond 是否配置了端口或来源条件
+func (h Host) HasCond() bool {
+	return len(h.ports) > 0 || len(h.sources) > 0
+}
+
+// MatchCond 检查目标端口和来源ip条件，未配置的条件不限制
+func (h Host) MatchCond(dstPort uint16, srcIP string) bool {
+	if len(h.ports) > 0 {
+		ok := false
+		for _, p := range h.ports {
+			if dstPort >= p.From && dstPort <= p.To {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(h.sources) > 0 {
+		ip := net.ParseIP(srcIP)
+		if ip == nil {
+			return false
+		}
+		for _, n := range h.sources {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// User 认证用户
+type User struct {
+	Name string `yaml:"name"` //用户名
+	Pass string `yaml:"pass"` //密码
+}
+
+// Socks5 socks5协议配置
+type Socks5 struct {
+	Users      []User `yaml:"users"`      //认证用户列表，为空不认证
+	UDPTimeout int    `yaml:"udpTimeout"` //UDP ASSOCIATE 空闲超时秒数，默认60
+}
+
+// HTTP http代理协议配置
+type HTTP struct {
+	Users []User `yaml:"users"` //Proxy-Authorization认证用户列表，为空不认证
+	Realm string `yaml:"realm"` //认证域，默认anyproxy
+
+	ErrorPages string `yaml:"errorPages"` //错误页模板目录，默认为配置文件所在目录下的errors
+}
+
+// TunnelToken tunnel服务端的命名密钥
+type TunnelToken struct {
+	Name  string   `yaml:"name"`  //名称，作为登录用户用于hosts规则和统计
+	Token string   `yaml:"token"` //通信密钥
+	Allow []string `yaml:"allow"` //允许访问的目标，支持域名、*.域名和CIDR，为空不限制
+}
+
+// TunnelTLS tunnels协议的TLS配置，相对路径以配置文件所在目录为准
+type TunnelTLS struct {
+	Cert       string `yaml:"cert"`       //证书文件，tunnel模式配置后只接受TLS连接，客户端配置后用于双向认证
+	Key        string `yaml:"key"`        //私钥文件
+	CA         string `yaml:"ca"`         //客户端校验tunnel证书的CA，为空用系统CA
+	ClientCA   string `yaml:"clientCA"`   //tunnel校验客户端证书的CA，为空不要求客户端证书
+	ServerName string `yaml:"serverName"` //客户端校验的证书名称，为空用代理地址
+}
+
+// Tunnel anyproxy 和 tunnel 通信配置
+type Tunnel struct {
+	Legacy bool          `yaml:"legacy"` //服务端是否兼容旧版AES-CBC加密的CONNECT请求，迁移期间使用
+	Window int           `yaml:"window"` //防重放时间窗口秒数，默认60
+	Tokens []TunnelToken `yaml:"tokens"` //服务端多个命名密钥，配置后全局token不再生效
+	TLS    TunnelTLS     `yaml:"tls"`    //tunnels协议的TLS配置
+}
+
+// DNSServer DNS服务器
+type DNSServer struct {
+	Name string `yaml:"name"` //名称，hosts和default的dns按名称选用
+	Addr string `yaml:"addr"` //地址 udp://ip:53、tcp://ip:53、https://域名/dns-query、tls://ip:853，不带协议为udp
+}
+
+// DNS 本地DNS解析配置
+type DNS struct {
+	Servers []DNSServer `yaml:"servers"` //DNS服务器列表
+	Local   []string    `yaml:"local"`   //dns为local时用的服务器名称，同时查询先返回的生效，为空用系统解析
+	Timeout int         `yaml:"timeout"` //单次查询超时秒数，默认5
+	Cache   DNSCache    `yaml:"cache"`   //解析结果缓存
+}
+
+// DNSCache 解析缓存，按记录的ttl缓存并限制在minTTL和maxTTL之间
+type DNSCache struct {
+	Size        int  `yaml:"size"`        //最多缓存的域名数，默认65536
+	MinTTL      int  `yaml:"minTTL"`      //最短缓存秒数，默认60
+	MaxTTL      int  `yaml:"maxTTL"`      //最长缓存秒数，默认3600
+	NegativeTTL int  `yaml:"negativeTTL"` //域名不存在时缓存秒数，默认30
+	Snapshot    bool `yaml:"snapshot"`    //是否定时保存到cacheDir，重启后加载
+}
+
+// Upstream 代理组，后台健康检查，请求时只从可用的代理中选择
+type Upstream struct {
+	Name     string      `yaml:"name"`     //名称，hosts中upstream按名称选用
+	Proxies  []string    `yaml:"proxies"`  //代理服务器列表，格式同hosts中的proxy
+	Strategy string      `yaml:"strategy"` //选择策略 failover 按顺序第一个可用, roundrobin 轮询, leastconn 最少连接, hash 按目标地址一致性哈希, latency 延迟最低，默认failover
+	Fallback string      `yaml:"fallback"` //都不可用时 last 走本地, deny 禁止，为空用全局代理
+	Retries  int         `yaml:"retries"`  //连接代理失败时换下一个代理重试的次数，默认1，-1不重试
+	Check    HealthCheck `yaml:"check"`    //健康检查
+}
+
+// HealthCheck 代理健康检查
+type HealthCheck struct {
+	Type     string `yaml:"type"`     //tcp 连接代理端口, http 经代理请求url，默认tcp
+	URL      string `yaml:"url"`      //http检查的地址，返回2xx或3xx为正常
+	Interval int    `yaml:"interval"` //检查间隔秒数，默认30
+	Timeout  int    `yaml:"timeout"`  //超时秒数，默认3
+}
+
+// Breaker 熔断，代理和auto直连的ip地址连续失败failures次后打开，cooldown秒后半开放行请求试探
+type Breaker struct {
+	Failures int `yaml:"failures"` //连续失败次数，默认3
+	Cooldown int `yaml:"cooldown"` //打开后冷却秒数，默认60
+}
+
+// Admin 管理接口
+type Admin struct {
+	Listen string `yaml:"listen"` //监听地址，为空不启动
+	Token  string `yaml:"token"`  //接口认证，请求头 Authorization: Bearer token，为空时只允许本机访问
+}
+
+// PAC 代理自动配置文件，按hosts和default规则生成
+type PAC struct {
+	Enable bool   `yaml:"enable"` //代理端口也响应 /proxy.pac 和 /wpad.dat，管理接口总是响应
+	Proxy  string `yaml:"proxy"`  //PAC中的代理地址 host:port，默认为请求PAC的域名加代理端口
 }
 
 // Log 日志
@@ -53,7 +227,7 @@ type Websocket struct {
 type Default struct {
 	Match     string `yaml:"match"`     //默认域名比对
 	Target    string `yaml:"target"`    //http默认访问策略
-	DNS       string `yaml:"dns"`       //默认的DNS服务器
+	DNS       string `yaml:"dns"`       //默认的DNS策略 local、remote 或dns.servers的名称
 	Proxy     string `yaml:"proxy"`     //全局代理服务器
 	TCPTarget string `yaml:"tcpTarget"` //tcp默认访问策略
 }
@@ -73,17 +247,27 @@ type FirstLine struct {
 
 // Router 配置文件模型
 type Router struct {
-	Listen    string    `yaml:"listen"`    //监听端口
-	Network   string    `yaml:"network"`   //监听协议
-	Log       Log       `yaml:"log"`       //日志目录
-	Watcher   bool      `yaml:"watcher"`   //是否监听配置文件变化
-	Token     string    `yaml:"token"`     //加密值, 和tunnel通信密钥, 必须16位长度
-	TcpCopy   TcpCopy   `yaml:"tcpcopy"`   //进行tcp转发模式
-	Default   Default   `yaml:"default"`   //默认配置
-	Hosts     []Host    `yaml:"hosts"`     //域名列表
-	AllowIP   []string  `yaml:"allowIP"`   //可以访问的客户端IP
-	FirstLine FirstLine `yaml:"firstLine"` //http请求首行域名和头部域名相同时删除首行域名
-	Websocket Websocket `yaml:"websocket"` //会话订阅请求信息
+	Listen    string     `yaml:"listen"`    //监听端口
+	Network   string     `yaml:"network"`   //监听协议
+	Log       Log        `yaml:"log"`       //日志目录
+	Watcher   bool       `yaml:"watcher"`   //是否监听配置文件变化
+	Token     string     `yaml:"token"`     //加密值, 和tunnel通信密钥, 兼容旧版时必须16位长度
+	Tunnel    Tunnel     `yaml:"tunnel"`    //和tunnel通信配置
+	TcpCopy   TcpCopy    `yaml:"tcpcopy"`   //进行tcp转发模式
+	Default   Default    `yaml:"default"`   //默认配置
+	Hosts     []Host     `yaml:"hosts"`     //域名列表
+	AllowIP   []string   `yaml:"allowIP"`   //可以访问的客户端IP
+	AllowUser []string   `yaml:"allowUser"` //可以访问的登录用户，为空不限制
+	Socks5    Socks5     `yaml:"socks5"`    //socks5协议配置
+	HTTP      HTTP       `yaml:"http"`      //http协议配置
+	FirstLine FirstLine  `yaml:"firstLine"` //http请求首行域名和头部域名相同时删除首行域名
+	Websocket Websocket  `yaml:"websocket"` //会话订阅请求信息
+	CacheDir  string     `yaml:"cacheDir"`  //缓存目录，默认为配置文件所在目录下的cache
+	Admin     Admin      `yaml:"admin"`     //管理接口
+	DNS       DNS        `yaml:"dns"`       //本地DNS解析
+	Upstreams []Upstream `yaml:"upstreams"` //代理组
+	Breaker   Breaker    `yaml:"breaker"`   //熔断
+	PAC       PAC        `yaml:"pac"`       //代理自动配置文件
 }
 
 // LoadRouterConfig 加载配置
@@ -92,10 +276,123 @@ func LoadRouterConfig(configPath string) (cnf Router, err error) {
 	if err != nil {
 		return
 	}
-	err = yaml.Unmarshal(data, &cnf)
+	return parseRouterConfig(data)
+}
+
+// parseRouterConfig 解析并校验配置，不认识的配置项和取值错误都带行号一起返回
+func parseRouterConfig(data []byte) (cnf Router, err error) {
+	var errs ConfigErrors
+	if err = yaml.UnmarshalStrict(data, &cnf); err != nil {
+		// 类型错误时其它配置项仍然解析了，继续校验
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return cnf, yamlErrors([]string{err.Error()})
+		}
+		errs = yamlErrors(typeErr.Errors)
+	}
+	errs = append(errs, cnf.validate(yamlLines(data))...)
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return cnf, errs
+	}
+	err = cnf.compileHosts()
 	return
 }
 
+// compileHosts 预编译正则、网段和端口条件，避免每次请求解析
+func (cnf *Router) compileHosts() (err error) {
+	for i := range cnf.Hosts {
+		h := &cnf.Hosts[i]
+		match := h.Match
+		if match == "" {
+			match = cnf.Default.Match
+		}
+		switch match {
+		case "preg":
+			h.pattern, err = regexp.Compile(h.Name)
+		case "glob":
+			h.pattern, err = regexp.Compile(globToRegexp(h.Name))
+		case "cidr":
+			if h.Name != "" {
+				h.cidr, err = parseCIDR(h.Name)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("hosts %s match %s: %w", h.Name, match, err)
+		}
+		for _, p := range h.Ports {
+			var r PortRange
+			if r, err = parsePortRange(p); err != nil {
+				return fmt.Errorf("hosts %s ports: %w", h.Name, err)
+			}
+			h.ports = append(h.ports, r)
+		}
+		for _, s := range h.Source {
+			var n *net.IPNet
+			if n, err = parseCIDR(s); err != nil {
+				return fmt.Errorf("hosts %s source: %w", h.Name, err)
+			}
+			h.sources = append(h.sources, n)
+		}
+	}
+	return nil
+}
+
+// parseCIDR 解析网段，单个ip按/32或/128处理
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePortRange 解析端口，格式如 3306 或 8000-8100
+func parsePortRange(s string) (r PortRange, err error) {
+	from, to := s, s
+	if idx := strings.IndexByte(s, '-'); idx >= 0 {
+		from, to = s[:idx], s[idx+1:]
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil {
+		return
+	}
+	if f > t {
+		err = fmt.Errorf("invalid port range %s", s)
+		return
+	}
+	return PortRange{From: uint16(f), To: uint16(t)}, nil
+}
+
+// globToRegexp 通配符转正则，*匹配任意字符，?匹配单个字符，不区分大小写
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
 // 获取文件路径
 func GetPath(filename string) (string, error) {
 	// 当前登录用户所在目录
@@ -0,0 +1,386 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// 远程规则集默认刷新间隔秒数
+	defaultRuleSetInterval = 86400
+	// 远程规则集最大字节数
+	maxRuleSetSize = 32 << 20
+)
+
+// RuleSet 规则集内容，加载后只读
+type RuleSet struct {
+	Exact   []string     //完全相等的域名
+	Suffix  []string     //匹配自身及子域名
+	Sub     []string     //只匹配子域名
+	Keyword []string     //包含关键字
+	CIDR    []*net.IPNet //ip网段
+}
+
+// ruleSetSource 规则集来源
+type ruleSetSource struct {
+	src      string
+	path     string // 本地文件，远程规则集为缓存文件
+	remote   bool
+	format   string
+	interval time.Duration
+	stop     chan struct{} // 配置中不再使用或参数变化时关闭
+}
+
+var (
+	ruleSetMu      sync.RWMutex
+	ruleSets       = make(map[string]*RuleSet)
+	ruleSetSources = make(map[string]*ruleSetSource)
+	ruleSetVersion int64
+)
+
+// GetRuleSet 取已加载的规则集，未加载时为nil
+func GetRuleSet(src string) *RuleSet {
+	ruleSetMu.RLock()
+	defer ruleSetMu.RUnlock()
+	return ruleSets[src]
+}
+
+// RuleSetVersion 规则集有变化时递增
+func RuleSetVersion() int64 {
+	return atomic.LoadInt64(&ruleSetVersion)
+}
+
+// loadRuleSets 按配置同步规则集，新出现的加载，format或interval变化的重建，不再使用的停止
+// 本地文件加入监听，远程规则集先读缓存再定时刷新，调用方需持有reloadMu
+func loadRuleSets(cnf *Router) {
+	want := make(map[string]Host)
+	for _, h := range cnf.Hosts {
+		if _, ok := want[h.Ruleset]; h.Ruleset != "" && !ok {
+			want[h.Ruleset] = h
+		}
+	}
+
+	var added []*ruleSetSource
+	ruleSetMu.Lock()
+	for src, s := range ruleSetSources {
+		if h, ok := want[src]; ok && newRuleSetSource(h).same(s) {
+			continue
+		}
+		close(s.stop)
+		delete(ruleSetSources, src)
+		delete(ruleSets, src)
+		if !s.remote && watcher != nil && !watchedRuleSet(s.path) {
+			watcher.Remove(s.path)
+		}
+		atomic.AddInt64(&ruleSetVersion, 1)
+		log.Println("ruleset stopped:", src)
+	}
+	for src, h := range want {
+		if _, ok := ruleSetSources[src]; ok {
+			continue
+		}
+		s := newRuleSetSource(h)
+		ruleSetSources[src] = s
+		added = append(added, s)
+	}
+	ruleSetMu.Unlock()
+
+	for _, s := range added {
+		if err := s.load(); err != nil {
+			log.Println("ruleset", s.src, "load err", err)
+		}
+		if s.remote {
+			go s.refresh()
+		} else if watcher != nil {
+			if err := watcher.Add(s.path); err != nil {
+				log.Println("ruleset", s.src, "watch err", err)
+			}
+		}
+	}
+}
+
+// watchedRuleSet 是否还有本地规则集使用该文件，调用方需持有ruleSetMu
+func watchedRuleSet(path string) bool {
+	for _, s := range ruleSetSources {
+		if !s.remote && s.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// newRuleSetSource 支持 file://路径、http(s)://地址 和不带协议的本地路径
+func newRuleSetSource(h Host) *ruleSetSource {
+	s := &ruleSetSource{
+		src:      h.Ruleset,
+		format:   h.Format,
+		interval: time.Duration(h.Interval) * time.Second,
+		stop:     make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultRuleSetInterval * time.Second
+	}
+	if strings.HasPrefix(s.src, "http://") || strings.HasPrefix(s.src, "https://") {
+		s.remote = true
+		sum := sha1.Sum([]byte(s.src))
+		s.path = filepath.Join(CacheDir(), "ruleset_"+hex.EncodeToString(sum[:8])+".txt")
+	} else {
+		s.path = findFile(strings.TrimPrefix(s.src, "file://"))
+	}
+	if s.format == "" && (strings.HasSuffix(s.src, ".yaml") || strings.HasSuffix(s.src, ".yml")) {
+		s.format = "clash"
+	}
+	return s
+}
+
+// same 来源参数相同时不用重建
+func (s *ruleSetSource) same(old *ruleSetSource) bool {
+	return s.path == old.path && s.format == old.format && s.interval == old.interval
+}
+
+// set 替换规则集内容，来源已停止或被重建时丢弃
+func (s *ruleSetSource) set(rs *RuleSet) bool {
+	ruleSetMu.Lock()
+	if ruleSetSources[s.src] != s {
+		ruleSetMu.Unlock()
+		return false
+	}
+	ruleSets[s.src] = rs
+	ruleSetMu.Unlock()
+	atomic.AddInt64(&ruleSetVersion, 1)
+	return true
+}
+
+// load 从本地文件或缓存加载
+func (s *ruleSetSource) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if s.remote && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	rs, err := parseRuleSet(data, s.format)
+	if err != nil {
+		return err
+	}
+	if s.set(rs) {
+		log.Println("ruleset loaded:", s.src)
+	}
+	return nil
+}
+
+// refresh 定时下载远程规则集, 来源停止后退出
+func (s *ruleSetSource) refresh() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+		}
+		if err := s.fetch(); err != nil {
+			log.Println("ruleset", s.src, "fetch err", err)
+		}
+		timer.Reset(s.interval)
+	}
+}
+
+// fetch 下载成功后写入缓存
+func (s *ruleSetSource) fetch() error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(s.src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	// 多读一个字节判断是否超出限制
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRuleSetSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxRuleSetSize {
+		return fmt.Errorf("ruleset larger than %d bytes", maxRuleSetSize)
+	}
+	rs, err := parseRuleSet(data, s.format)
+	if err != nil {
+		return err
+	}
+	if !s.set(rs) {
+		return nil
+	}
+	// 先写临时文件再改名，避免缓存文件不完整
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// reloadRuleSetFile 本地规则集文件变化时重新加载
+func reloadRuleSetFile(path string) {
+	ruleSetMu.RLock()
+	var list []*ruleSetSource
+	for _, s := range ruleSetSources {
+		if !s.remote && s.path == path {
+			list = append(list, s)
+		}
+	}
+	ruleSetMu.RUnlock()
+	for _, s := range list {
+		if err := s.load(); err != nil {
+			log.Println("ruleset", s.src, "reload err", err)
+		}
+	}
+}
+
+// parseRuleSet 解析规则集，format 为 plain、hosts、clash，为空时按内容识别
+func parseRuleSet(data []byte, format string) (*RuleSet, error) {
+	if format == "" && bytes.HasPrefix(bytes.TrimSpace(data), []byte("payload:")) {
+		format = "clash"
+	}
+	rs := &RuleSet{}
+	switch format {
+	case "clash":
+		var provider struct {
+			Payload []string `yaml:"payload"`
+		}
+		if err := yaml.Unmarshal(data, &provider); err != nil {
+			return nil, err
+		}
+		for _, line := range provider.Payload {
+			rs.addClash(strings.TrimSpace(line))
+		}
+	case "", "plain", "hosts":
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if idx := strings.IndexByte(line, '#'); idx >= 0 {
+				line = line[:idx]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			// hosts 格式: ip 域名1 域名2
+			if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+				if format != "plain" {
+					rs.addHosts(fields[1:])
+				}
+				continue
+			}
+			if format != "hosts" {
+				rs.addPlain(fields[0])
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ruleset format %s is not supported", format)
+	}
+	return rs, nil
+}
+
+// addPlain 每行一个域名，匹配自身及子域名，*.开头只匹配子域名，也支持ip和网段
+func (rs *RuleSet) addPlain(line string) {
+	line = strings.ToLower(line)
+	if n := ruleCIDR(line); n != nil {
+		rs.CIDR = append(rs.CIDR, n)
+		return
+	}
+	switch {
+	case strings.HasPrefix(line, "*."):
+		rs.Sub = append(rs.Sub, line[2:])
+	case strings.HasPrefix(line, "+."):
+		rs.Suffix = append(rs.Suffix, line[2:])
+	default:
+		rs.Suffix = append(rs.Suffix, strings.TrimPrefix(line, "."))
+	}
+}
+
+// addHosts hosts文件中的域名完全相等匹配
+func (rs *RuleSet) addHosts(names []string) {
+	for _, name := range names {
+		name = strings.ToLower(name)
+		switch name {
+		case "localhost", "localhost.localdomain", "local", "broadcasthost":
+			continue
+		}
+		rs.Exact = append(rs.Exact, name)
+	}
+}
+
+// addClash clash rule-provider 的 domain、ipcidr 和 classical 格式
+func (rs *RuleSet) addClash(line string) {
+	if line == "" {
+		return
+	}
+	if strings.Contains(line, ",") {
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return
+		}
+		value := strings.ToLower(strings.TrimSpace(fields[1]))
+		switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+		case "DOMAIN":
+			rs.Exact = append(rs.Exact, value)
+		case "DOMAIN-SUFFIX":
+			rs.Suffix = append(rs.Suffix, value)
+		case "DOMAIN-KEYWORD":
+			rs.Keyword = append(rs.Keyword, value)
+		case "IP-CIDR", "IP-CIDR6":
+			if n := ruleCIDR(value); n != nil {
+				rs.CIDR = append(rs.CIDR, n)
+			}
+		}
+		return
+	}
+	line = strings.ToLower(strings.Trim(line, "'\""))
+	if n := ruleCIDR(line); n != nil {
+		rs.CIDR = append(rs.CIDR, n)
+		return
+	}
+	switch {
+	case strings.HasPrefix(line, "+."):
+		rs.Suffix = append(rs.Suffix, line[2:])
+	case strings.HasPrefix(line, "*."):
+		rs.Sub = append(rs.Sub, line[2:])
+	case strings.HasPrefix(line, "."):
+		rs.Sub = append(rs.Sub, line[1:])
+	default:
+		rs.Exact = append(rs.Exact, line)
+	}
+}
+
+// ruleCIDR 解析ip或网段，不是时返回nil
+func ruleCIDR(s string) *net.IPNet {
+	if !strings.Contains(s, "/") && net.ParseIP(s) == nil {
+		return nil
+	}
+	n, err := parseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,131 @@
+package conf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetRuleSets 停止所有来源并清空全局状态
+func resetRuleSets(t *testing.T) {
+	t.Cleanup(func() {
+		reloadMu.Lock()
+		loadRuleSets(&Router{})
+		reloadMu.Unlock()
+		ConfigFile = ""
+	})
+	dir := t.TempDir()
+	ConfigFile = filepath.Join(dir, "router.yaml")
+}
+
+func stopped(s *ruleSetSource) bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLoadRuleSetsSync(t *testing.T) {
+	resetRuleSets(t)
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cnf := &Router{Hosts: []Host{{Ruleset: path, Format: "plain"}}}
+	loadRuleSets(cnf)
+	s1 := ruleSetSources[path]
+	if s1 == nil || GetRuleSet(path) == nil {
+		t.Fatal("ruleset not loaded")
+	}
+
+	// 参数不变不重建
+	loadRuleSets(cnf)
+	if ruleSetSources[path] != s1 || stopped(s1) {
+		t.Fatal("unchanged source rebuilt")
+	}
+
+	// format变化重建
+	loadRuleSets(&Router{Hosts: []Host{{Ruleset: path, Format: "hosts"}}})
+	s2 := ruleSetSources[path]
+	if s2 == s1 || !stopped(s1) || s2.format != "hosts" {
+		t.Fatal("source not rebuilt on format change")
+	}
+	if GetRuleSet(path) == nil {
+		t.Fatal("rebuilt ruleset not loaded")
+	}
+
+	// 旧来源不能覆盖新来源的内容
+	if s1.set(&RuleSet{}) {
+		t.Fatal("stopped source replaced ruleset")
+	}
+
+	// 不再使用的停止
+	version := RuleSetVersion()
+	loadRuleSets(&Router{})
+	if len(ruleSetSources) != 0 || GetRuleSet(path) != nil || !stopped(s2) {
+		t.Fatal("removed source not stopped")
+	}
+	if RuleSetVersion() == version {
+		t.Fatal("version not bumped on removal")
+	}
+}
+
+func TestRuleSetRefreshStops(t *testing.T) {
+	resetRuleSets(t)
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("example.com\n"))
+	}))
+	defer srv.Close()
+
+	src := srv.URL + "/rules.txt"
+	loadRuleSets(&Router{Hosts: []Host{{Ruleset: src, Interval: 1}}})
+	s := ruleSetSources[src]
+	deadline := time.Now().Add(2 * time.Second)
+	for GetRuleSet(src) == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if GetRuleSet(src) == nil {
+		t.Fatal("remote ruleset not fetched")
+	}
+	if _, err := os.Stat(s.path); err != nil {
+		t.Fatal("cache file not written", err)
+	}
+
+	// interval变化重建，旧的刷新协程退出
+	loadRuleSets(&Router{Hosts: []Host{{Ruleset: src, Interval: 3600}}})
+	if !stopped(s) || ruleSetSources[src] == s {
+		t.Fatal("source not rebuilt on interval change")
+	}
+	loadRuleSets(&Router{})
+	time.Sleep(100 * time.Millisecond)
+	n := atomic.LoadInt32(&hits)
+	time.Sleep(1500 * time.Millisecond)
+	if got := atomic.LoadInt32(&hits); got != n {
+		t.Fatalf("stopped source still fetching: %d > %d", got, n)
+	}
+}
+
+func TestFetchRuleSetLimit(t *testing.T) {
+	resetRuleSets(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", maxRuleSetSize+1)))
+	}))
+	defer srv.Close()
+
+	s := newRuleSetSource(Host{Ruleset: srv.URL})
+	if err := s.fetch(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("fetch err = %v", err)
+	}
+	if _, err := os.Stat(s.path); !os.IsNotExist(err) {
+		t.Fatal("oversized ruleset cached")
+	}
+}
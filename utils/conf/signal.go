@@ -0,0 +1,22 @@
+// +build !windows
+
+package conf
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReloadOnSignal 收到SIGUSR1时重新加载配置
+func ReloadOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			log.Println(os.Getpid(), "Received SIGUSR1. reloading config.")
+			Reload("signal")
+		}
+	}()
+}
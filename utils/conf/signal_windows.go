@@ -0,0 +1,4 @@
+package conf
+
+// ReloadOnSignal windows没有SIGUSR1，只能通过文件监听和管理接口重新加载
+func ReloadOnSignal() {}
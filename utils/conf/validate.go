@@ -0,0 +1,418 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/keminar/anyproxy/config"
+	"github.com/keminar/anyproxy/dns"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// ConfigError 配置错误，Line为yaml行号，未知时为0
+type ConfigError struct {
+	Line int    `json:"line,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+// ConfigErrors 配置中的所有错误
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	list := make([]string, 0, len(e))
+	for _, ce := range e {
+		list = append(list, ce.Error())
+	}
+	return strings.Join(list, "\n")
+}
+
+// yaml.v2 的错误格式为 "line 12: field xx not found in type conf.Host"
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors 转换yaml解析错误，保留行号
+func yamlErrors(msgs []string) (errs ConfigErrors) {
+	for _, msg := range msgs {
+		if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			errs = append(errs, ConfigError{Line: line, Msg: m[2]})
+		} else {
+			errs = append(errs, ConfigError{Msg: msg})
+		}
+	}
+	return
+}
+
+// validator 校验配置语义，错误带上配置项所在行号
+type validator struct {
+	lines map[string]int
+	errs  ConfigErrors
+}
+
+// add 记录错误，path 为 hosts.2.target 形式的配置路径
+func (v *validator) add(path string, format string, a ...interface{}) {
+	v.errs = append(v.errs, ConfigError{
+		Line: v.line(path),
+		Msg:  displayPath(path) + " " + fmt.Sprintf(format, a...),
+	})
+}
+
+// line 找不到配置项时取上一级的行号，如 allowIP: [a, b] 的元素
+func (v *validator) line(path string) int {
+	for path != "" {
+		if n, ok := v.lines[path]; ok {
+			return n
+		}
+		idx := strings.LastIndexByte(path, '.')
+		if idx < 0 {
+			break
+		}
+		path = path[:idx]
+	}
+	return 0
+}
+
+// oneOf 检查取值，空值用默认不检查
+func (v *validator) oneOf(path, value string, values ...string) {
+	if value == "" || inList(values, value) {
+		return
+	}
+	v.add(path, "%q is invalid, must be %s", value, strings.Join(values, ", "))
+}
+
+// cidrs 检查ip或网段列表
+func (v *validator) cidrs(path string, list []string) {
+	for i, s := range list {
+		if _, err := parseCIDR(s); err != nil {
+			v.add(fmt.Sprintf("%s.%d", path, i), "%q is not a valid ip or cidr", s)
+		}
+	}
+}
+
+// allowRe 密钥允许访问的域名，支持 *.域名
+var allowRe = regexp.MustCompile(`^(\*\.)?([A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?\.)*[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?$`)
+
+// allows 检查密钥允许访问的目标，支持域名、*.域名、ip和CIDR
+func (v *validator) allows(path string, list []string) {
+	for i, s := range list {
+		if _, err := parseCIDR(s); err == nil {
+			continue
+		}
+		if strings.ContainsAny(s, "/:") || !allowRe.MatchString(s) {
+			v.add(fmt.Sprintf("%s.%d", path, i), "%q is not a valid domain, *.domain, ip or cidr", s)
+		}
+	}
+}
+
+// proxy 检查代理服务器，支持逗号分隔的多个代理和 " last"、" deny" 结尾
+func (v *validator) proxy(path, value string) {
+	if value == "" {
+		return
+	}
+	if strings.HasSuffix(value, " last") || strings.HasSuffix(value, " deny") {
+		value = value[:len(value)-5]
+	}
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		spec, err := config.ParseProxy(p)
+		if err != nil {
+			v.add(path, "%q is not a valid proxy: %s", p, err)
+			continue
+		}
+		if !inList(proxySchemes, spec.Scheme) {
+			v.add(path, "%q scheme %s is not supported, must be %s", p, spec.Scheme, strings.Join(proxySchemes, ", "))
+		}
+	}
+}
+
+// dns 检查DNS策略，local、remote 或逗号分隔的服务器名称
+func (v *validator) dns(path, value string, names map[string]bool) {
+	if value == "" || value == "local" || value == "remote" {
+		return
+	}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); !names[name] {
+			v.add(path, "%q is invalid, must be local, remote or a name in dns.servers", name)
+		}
+	}
+}
+
+// validateDNS 检查DNS服务器，返回已配置的名称
+func (cnf *Router) validateDNS(v *validator) map[string]bool {
+	names := make(map[string]bool)
+	for i, s := range cnf.DNS.Servers {
+		path := fmt.Sprintf("dns.servers.%d", i)
+		switch {
+		case s.Name == "":
+			v.add(path+".name", "is empty")
+		case s.Name == "local" || s.Name == "remote":
+			v.add(path+".name", "%q is reserved", s.Name)
+		case names[s.Name]:
+			v.add(path+".name", "%q is duplicated", s.Name)
+		}
+		names[s.Name] = true
+		if _, _, err := dns.ParseAddr(s.Addr); err != nil || s.Addr == "" {
+			v.add(path+".addr", "%q is not a valid dns server", s.Addr)
+		}
+	}
+	for i, name := range cnf.DNS.Local {
+		if !names[name] {
+			v.add(fmt.Sprintf("dns.local.%d", i), "%q is not a name in dns.servers", name)
+		}
+	}
+	c := cnf.DNS.Cache
+	for i, n := range []int{c.Size, c.MinTTL, c.MaxTTL, c.NegativeTTL} {
+		if n < 0 {
+			key := []string{"size", "minTTL", "maxTTL", "negativeTTL"}[i]
+			v.add("dns.cache."+key, "must not be negative, got %d", n)
+		}
+	}
+	if c.MinTTL > 0 && c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+		v.add("dns.cache.maxTTL", "%d is less than minTTL %d", c.MaxTTL, c.MinTTL)
+	}
+	return names
+}
+
+// validateUpstreams 检查代理组，返回已配置的名称
+func (cnf *Router) validateUpstreams(v *validator) map[string]bool {
+	names := make(map[string]bool)
+	for i, u := range cnf.Upstreams {
+		path := fmt.Sprintf("upstreams.%d", i)
+		if u.Name == "" {
+			v.add(path+".name", "is empty")
+		} else if names[u.Name] {
+			v.add(path+".name", "%q is duplicated", u.Name)
+		}
+		names[u.Name] = true
+		if len(u.Proxies) == 0 {
+			v.add(path+".proxies", "is empty")
+		}
+		for j, p := range u.Proxies {
+			v.proxy(fmt.Sprintf("%s.proxies.%d", path, j), p)
+		}
+		v.oneOf(path+".strategy", u.Strategy, upstreamStrategies...)
+		v.oneOf(path+".fallback", u.Fallback, "last", "deny")
+		v.oneOf(path+".check.type", u.Check.Type, "tcp", "http")
+		if u.Check.Type == "http" {
+			if uri, err := url.Parse(u.Check.URL); err != nil || (uri.Scheme != "http" && uri.Scheme != "https") || uri.Host == "" {
+				v.add(path+".check.url", "%q is not a valid http(s) url", u.Check.URL)
+			}
+		}
+		if u.Retries < -1 {
+			v.add(path+".retries", "must be -1 or more, got %d", u.Retries)
+		}
+		if u.Check.Interval < 0 || u.Check.Timeout < 0 {
+			v.add(path+".check", "interval and timeout must not be negative")
+		}
+	}
+	return names
+}
+
+// legacyToken 兼容旧版时密钥必须16位
+func (v *validator) legacyToken(path, token string) {
+	if token != "" && len(token) != 16 {
+		v.add(path, "length must be 16 when tunnel.legacy is on, got %d", len(token))
+	}
+}
+
+var (
+	matchModes   = []string{"contain", "equal", "suffix", "glob", "preg", "cidr"}
+	targetModes  = []string{"local", "remote", "deny", "auto"}
+	proxySchemes = []string{"http", "socks5", "tunnel", "tunnels"}
+	// upstreamStrategies 代理组选择策略
+	upstreamStrategies = []string{"failover", "roundrobin", "leastconn", "hash", "latency"}
+)
+
+// validate 检查配置取值，返回所有错误
+func (cnf *Router) validate(lines map[string]int) ConfigErrors {
+	v := &validator{lines: lines}
+	v.oneOf("network", cnf.Network, "tcp", "tcp4", "tcp6")
+	v.oneOf("default.match", cnf.Default.Match, matchModes...)
+	v.oneOf("default.target", cnf.Default.Target, targetModes...)
+	v.oneOf("default.tcpTarget", cnf.Default.TCPTarget, targetModes...)
+	names := cnf.validateDNS(v)
+	v.dns("default.dns", cnf.Default.DNS, names)
+	v.proxy("default.proxy", cnf.Default.Proxy)
+	v.cidrs("allowIP", cnf.AllowIP)
+	upstreams := cnf.validateUpstreams(v)
+	if cnf.Breaker.Failures < 0 || cnf.Breaker.Cooldown < 0 {
+		v.add("breaker", "failures and cooldown must not be negative")
+	}
+	if cnf.PAC.Proxy != "" {
+		if _, port, err := net.SplitHostPort(cnf.PAC.Proxy); err != nil || port == "" {
+			v.add("pac.proxy", "%q must be host:port", cnf.PAC.Proxy)
+		}
+	}
+
+	if cnf.Tunnel.Legacy {
+		v.legacyToken("token", cnf.Token)
+		// 旧版CBC不带认证，多个密钥时可能用错的密钥解出看似正常的地址
+		if len(cnf.Tunnel.Tokens) > 1 {
+			v.add("tunnel.tokens", "only one token is allowed when tunnel.legacy is on, got %d", len(cnf.Tunnel.Tokens))
+		}
+	}
+	names, tokens := make(map[string]bool), make(map[string]bool)
+	for i, tk := range cnf.Tunnel.Tokens {
+		path := fmt.Sprintf("tunnel.tokens.%d", i)
+		// 名称作为登录用户，重复时无法区分
+		if tk.Name != "" && names[tk.Name] {
+			v.add(path+".name", "%q is duplicated", tk.Name)
+		}
+		names[tk.Name] = true
+		switch {
+		case tk.Token == "":
+			v.add(path+".token", "is empty")
+		case tokens[tk.Token]:
+			v.add(path+".token", "is duplicated")
+		case cnf.Tunnel.Legacy:
+			v.legacyToken(path+".token", tk.Token)
+		}
+		tokens[tk.Token] = true
+		v.allows(path+".allow", tk.Allow)
+	}
+	if (cnf.Tunnel.TLS.Cert == "") != (cnf.Tunnel.TLS.Key == "") {
+		v.add("tunnel.tls", "cert and key must be set together")
+	}
+
+	for i, h := range cnf.Hosts {
+		path := fmt.Sprintf("hosts.%d", i)
+		v.oneOf(path+".match", h.Match, matchModes...)
+		v.oneOf(path+".target", h.Target, targetModes...)
+		v.dns(path+".dns", h.DNS, names)
+		v.oneOf(path+".prefer", h.Prefer, "ipv4", "ipv6")
+		v.proxy(path+".proxy", h.Proxy)
+		if h.Upstream != "" && !upstreams[h.Upstream] {
+			v.add(path+".upstream", "%q is not a name in upstreams", h.Upstream)
+		}
+		v.cidrs(path+".allowIP", h.AllowIP)
+		v.cidrs(path+".source", h.Source)
+		for j, p := range h.Ports {
+			if _, err := parsePortRange(p); err != nil {
+				v.add(fmt.Sprintf("%s.ports.%d", path, j), "%q is not a valid port or range", p)
+			}
+		}
+		if h.Ruleset != "" {
+			v.oneOf(path+".format", h.Format, "plain", "hosts", "clash")
+			continue
+		}
+		if h.Name == "" && len(h.Ports) == 0 && len(h.Source) == 0 {
+			v.add(path, "name is empty, set name, ports or source")
+			continue
+		}
+		match := h.Match
+		if match == "" {
+			match = cnf.Default.Match
+		}
+		var err error
+		switch match {
+		case "preg":
+			_, err = regexp.Compile(h.Name)
+		case "glob":
+			_, err = regexp.Compile(globToRegexp(h.Name))
+		case "cidr":
+			if h.Name != "" {
+				_, err = parseCIDR(h.Name)
+			}
+		}
+		if err != nil {
+			v.add(path+".name", "%q is invalid for match %s: %s", h.Name, match, err)
+		}
+	}
+	return v.errs
+}
+
+// displayPath hosts.2.target 显示为 hosts[2].target
+func displayPath(path string) string {
+	var b strings.Builder
+	for i, seg := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(seg); err == nil {
+			b.WriteString("[" + seg + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+func inList(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlLines 记录yaml中各配置项的行号，键为 hosts.2.target 形式的路径，只用于错误提示
+// 同一路径取第一次出现的行，合并(<<)进来的键不覆盖本层的
+func yamlLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return lines
+	}
+	set := func(path string, line int) {
+		if _, ok := lines[path]; !ok {
+			lines[path] = line
+		}
+	}
+	join := func(path, key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	var walk func(path string, n *yaml3.Node)
+	walk = func(path string, n *yaml3.Node) {
+		switch n.Kind {
+		case yaml3.DocumentNode:
+			for _, c := range n.Content {
+				walk(path, c)
+			}
+		case yaml3.AliasNode:
+			walk(path, n.Alias)
+		case yaml3.SequenceNode:
+			for i, c := range n.Content {
+				p := join(path, strconv.Itoa(i))
+				set(p, c.Line)
+				walk(p, c)
+			}
+		case yaml3.MappingNode:
+			var merges []*yaml3.Node
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				if k.Tag == "!!merge" {
+					merges = append(merges, v)
+					continue
+				}
+				p := join(path, k.Value)
+				set(p, k.Line)
+				walk(p, v)
+			}
+			for _, v := range merges {
+				if v.Kind == yaml3.SequenceNode {
+					for _, c := range v.Content {
+						walk(path, c)
+					}
+				} else {
+					walk(path, v)
+				}
+			}
+		}
+	}
+	walk("", &doc)
+	return lines
+}
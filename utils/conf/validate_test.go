@@ -0,0 +1,117 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+// parseErrors 解析配置，返回所有错误
+func parseErrors(t *testing.T, data string) ConfigErrors {
+	t.Helper()
+	_, err := parseRouterConfig([]byte(data))
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("err = %v", err)
+	}
+	return errs
+}
+
+func TestValidateLegacyTokens(t *testing.T) {
+	data := `
+tunnel:
+  legacy: true
+  tokens:
+    - name: a
+      token: "0123456789abcdef"
+`
+	if errs := parseErrors(t, data); len(errs) != 0 {
+		t.Fatalf("single legacy token: %v", errs)
+	}
+	data += `    - name: b
+      token: "fedcba9876543210"
+`
+	errs := parseErrors(t, data)
+	if len(errs) != 1 || errs[0].Line != 4 || !strings.Contains(errs[0].Msg, "only one token") {
+		t.Fatalf("errs = %v", errs)
+	}
+}
+
+func TestYamlLines(t *testing.T) {
+	data := `# 注释
+name: |
+  multi
+  target: not a key
+hosts:
+  - {name: a.com, target: local}
+  - name: b.com
+    target: remote
+    allowIP: [10.0.0.0/8, 1.2.3.4]
+base: &base
+  target: deny
+  dns: local
+override:
+  <<: *base
+  target: auto
+tunnel:
+  tokens:
+    - name: target
+`
+	lines := yamlLines([]byte(data))
+	tests := map[string]int{
+		"name":                 2,
+		"hosts.0":              6,
+		"hosts.0.target":       6,
+		"hosts.1.target":       8,
+		"hosts.1.allowIP.1":    9,
+		"override.target":      15,
+		"override.dns":         12,
+		"tunnel.tokens.0":      18,
+		"tunnel.tokens.0.name": 18,
+	}
+	for path, want := range tests {
+		if got := lines[path]; got != want {
+			t.Errorf("line of %s = %d, want %d", path, got, want)
+		}
+	}
+	if _, ok := lines["target"]; ok {
+		t.Error("key in multi-line scalar recorded")
+	}
+}
+
+func TestValidateTunnelTokens(t *testing.T) {
+	data := `
+tunnel:
+  tokens:
+    - name: a
+      token: token-a
+      allow: ["*.example.com", example.org, 10.0.0.0/8, "::1"]
+    - name: a
+      token: token-a
+      allow:
+        - "http://example.com"
+        - 10.0.0.0/33
+        - "a.*.com"
+`
+	want := []struct {
+		line int
+		msg  string
+	}{
+		{7, "tunnel.tokens[1].name \"a\" is duplicated"},
+		{8, "tunnel.tokens[1].token is duplicated"},
+		{10, "tunnel.tokens[1].allow[0] \"http://example.com\" is not a valid"},
+		{11, "tunnel.tokens[1].allow[1] \"10.0.0.0/33\" is not a valid"},
+		{12, "tunnel.tokens[1].allow[2] \"a.*.com\" is not a valid"},
+	}
+	errs := parseErrors(t, data)
+	if len(errs) != len(want) {
+		t.Fatalf("errs = %v", errs)
+	}
+	for i, w := range want {
+		if errs[i].Line != w.line || !strings.HasPrefix(errs[i].Msg, w.msg) {
+			t.Errorf("err %d = %v, want line %d: %s", i, errs[i], w.line, w.msg)
+		}
+	}
+}
@@ -23,8 +23,11 @@ func Usage() {
 	fmt.Fprintf(os.Stdout, "  -l=ADDRPORT      Address and port to listen on (e.g., :3000 or 127.0.0.1:3000)\n")
 	fmt.Fprintf(os.Stdout, "  -p=PROXIES       Address and ports of upstream proxy servers to use\n")
 	fmt.Fprintf(os.Stdout, "                   (e.g., 10.1.1.1:80 will use http proxy, socks5://10.2.2.2:3128 use socks5 proxy,\n")
-	fmt.Fprintf(os.Stdout, "                   tunnel://10.2.2.2:3001 use tunnel proxy)\n")
+	fmt.Fprintf(os.Stdout, "                   tunnel://10.2.2.2:3001 use tunnel proxy, tunnel://10.2.2.2:3001?token=xxx with token,\n")
+	fmt.Fprintf(os.Stdout, "                   tunnels://10.2.2.2:3001 use tunnel proxy over tls,\n")
+	fmt.Fprintf(os.Stdout, "                   http://user:pass@[::1]:8888 use http proxy with auth)\n")
 	fmt.Fprintf(os.Stdout, "  -c=FILEPATH      Config file path, default is router.yaml\n")
+	fmt.Fprintf(os.Stdout, "  -t               Test config file, report every error with line number and exit\n")
 	fmt.Fprintf(os.Stdout, "Optional\n")
 	fmt.Fprintf(os.Stdout, "  -ws-listen       Websocket address and port to listen on\n")
 	fmt.Fprintf(os.Stdout, "  -ws-connect      Websocket Address and port to connect\n")
@@ -34,6 +37,9 @@ func Usage() {
 	fmt.Fprintf(os.Stdout, "  -pprof           Pprof port, disable if empty\n")
 	fmt.Fprintf(os.Stdout, "  -v               Show build version\n\n")
 	fmt.Fprintf(os.Stdout, "  -h               This usage message\n\n")
+	fmt.Fprintf(os.Stdout, "Commands\n")
+	fmt.Fprintf(os.Stdout, "  route explain <host[:port]> [-proto http|https|tcp] [-from ip] [-user name] [-json]\n")
+	fmt.Fprintf(os.Stdout, "                   Show which rule, target, dns and upstream would be used, no traffic is forwarded\n\n")
 
 	fmt.Fprintf(os.Stdout, "Before starting anyproxy, be sure to change the number of available file handles to at least 65535\n")
 	fmt.Fprintf(os.Stdout, "with \"ulimit -n 65535\"\n") //重要